@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Receipts are submitted on behalf of an account by sending its ID in an
+Account-Id header. Accounts aren't created separately: the store starts
+keeping an account's ledger (see ledger.go) when its first receipt arrives.
+IDs are chosen by the client, e.g. a loyalty card number, and may use
+letters, digits, '-' and '_'.
+*/
+var accountIdRegex = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+// Reads the account a request is made on behalf of, which is empty if there
+// is no Account-Id header. The returned bool is false, and the client has been
+// sent a 400, if the header holds an invalid ID.
+func requestAccount(w http.ResponseWriter, req *http.Request) (string, bool) {
+
+	accountId := req.Header.Get("Account-Id")
+	if accountId != "" && !accountIdRegex.MatchString(accountId) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The Account-Id header may only contain up to 64 letters, digits, '-' and '_'.")
+		return "", false
+	}
+	return accountId, true
+
+}
+
+/*
+BalanceResponse is the body returned for GET requests to
+/accounts/{id}/balance. Version is the sequence number of the latest entry in
+the account's ledger, and is also sent as the response's ETag, for use in the
+If-Match header of a redemption.
+*/
+type BalanceResponse struct {
+	AccountId string `json:"accountId"`
+	Balance   int    `json:"balance"`
+	Version   int    `json:"version"`
+}
+
+// Sends the client the appropriate response for a failed account lookup, and
+// returns false, or returns true if there was no error
+func checkAccountLookup(w http.ResponseWriter, err error) bool {
+
+	if errors.Is(err, errAccountNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No account found for that ID.")
+		return false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The account could not be read.")
+		return false
+	}
+	return true
+
+}
+
+// Formats an account's version as an ETag
+func accountETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// Handler for GET requests to /accounts/{id}/balance
+func getAccountBalance(w http.ResponseWriter, req *http.Request) {
+
+	accountId := strings.Split(req.URL.Path, "/")[2]
+
+	balance, version, err := store.GetBalance(accountId)
+	if !checkAccountLookup(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", accountETag(version))
+	json.NewEncoder(w).Encode(BalanceResponse{AccountId: accountId, Balance: balance, Version: version})
+
+}
+
+/*
+LedgerResponse is the body returned for GET requests to /accounts/{id}/ledger:
+every entry in the account's ledger, oldest first. The entries' points always
+sum to the balance.
+*/
+type LedgerResponse struct {
+	AccountId string        `json:"accountId"`
+	Balance   int           `json:"balance"`
+	Version   int           `json:"version"`
+	Entries   []LedgerEntry `json:"entries"`
+}
+
+// Handler for GET requests to /accounts/{id}/ledger
+func getAccountLedger(w http.ResponseWriter, req *http.Request) {
+
+	accountId := strings.Split(req.URL.Path, "/")[2]
+
+	entries, err := store.GetLedger(accountId)
+	if !checkAccountLookup(w, err) {
+		return
+	}
+
+	resp := LedgerResponse{AccountId: accountId, Entries: []LedgerEntry{}}
+	if len(entries) > 0 {
+		resp.Entries = entries
+		resp.Balance = entries[len(entries)-1].Balance
+		resp.Version = entries[len(entries)-1].Sequence
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", accountETag(resp.Version))
+	json.NewEncoder(w).Encode(resp)
+
+}
+
+// RedemptionRequest is the body expected for POST requests to
+// /accounts/{id}/redemptions
+type RedemptionRequest struct {
+	Points      int    `json:"points"`
+	Description string `json:"description"`
+}
+
+// RedemptionResponse is the body returned for a successful redemption
+type RedemptionResponse struct {
+	AccountId string      `json:"accountId"`
+	Entry     LedgerEntry `json:"entry"`
+}
+
+/*
+Handler for POST requests to /accounts/{id}/redemptions, which spends points
+from the account's balance.
+
+The request must carry an If-Match header holding the account's version, as
+returned in the ETag of its balance or ledger. If anything has been posted to
+the account since, the redemption is refused with a 412, so that two clients
+spending from the same balance at once can't both succeed on the strength of
+the same balance. A redemption of more points than the balance holds gets a
+422.
+*/
+func postRedemption(w http.ResponseWriter, req *http.Request) {
+
+	accountId := strings.Split(req.URL.Path, "/")[2]
+
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		fmt.Fprintf(w, "Redemptions need an If-Match header with the account's version.")
+		return
+	}
+	version, err := strconv.Atoi(strings.Trim(ifMatch, `"`))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The If-Match header must hold the account's version, as given by its ETag.")
+		return
+	}
+
+	var redemption RedemptionRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+	var tooLarge *http.MaxBytesError
+	if err := decoder.Decode(&redemption); errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "The request body is larger than the limit of %d bytes.", tooLarge.Limit)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The redemption is not valid JSON: %s", err)
+		return
+	}
+	if redemption.Points <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The redemption must be for a positive number of points.")
+		return
+	}
+
+	entry, err := store.PostEntry(accountId, version, LedgerEntry{
+		Kind:        entryRedemption,
+		Points:      -redemption.Points,
+		Description: redemption.Description,
+		CreatedAt:   time.Now(),
+	})
+	switch {
+	case errors.Is(err, errVersionConflict):
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "The account has changed since version %d; fetch its balance and try again.", version)
+		return
+	case errors.Is(err, errInsufficientPoints):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "The account doesn't have %d points to redeem.", redemption.Points)
+		return
+	case !checkAccountLookup(w, err):
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", accountETag(entry.Sequence))
+	json.NewEncoder(w).Encode(RedemptionResponse{AccountId: accountId, Entry: entry})
+
+}
+
+// Handler for GET requests to /accounts/{id}/receipts, which returns a page of
+// the account's receipts (see pagination.go)
+func getAccountReceipts(w http.ResponseWriter, req *http.Request) {
+
+	accountId := strings.Split(req.URL.Path, "/")[2]
+
+	page, err := readPageRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	ids, err := store.ListAccountReceipts(accountId)
+	if !checkAccountLookup(w, err) {
+		return
+	}
+
+	result, err := buildReceiptPage(ids, page, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The account's receipts could not be read.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Submits the payload on behalf of the account and returns the receipt's ID
+func testPostForAccountHelper(t *testing.T, payload string, accountId string) string {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewBufferString(payload))
+	req.Header.Set("Account-Id", accountId)
+	w := httptest.NewRecorder()
+	processReceipt(w, req)
+
+	var pr ProcessResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &pr); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected OK but got %v: %s", w.Code, w.Body)
+	}
+	return pr.Id
+
+}
+
+// Sends a GET request to the account handler and returns the recorded
+// response
+func testGetAccountHelper(t *testing.T, handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+
+}
+
+// A receipt purchased on the given day of January 2022, earning 31 points
+// plus 6 on odd days
+func accountPayload(day string) string {
+
+	return `{"retailer": "Target", "purchaseDate": "2022-01-` + day + `", "purchaseTime": "13:13", "total": "1.25",
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]}`
+
+}
+
+func TestAccountBalance(t *testing.T) {
+
+	useFreshStore(t)
+
+	testPostForAccountHelper(t, accountPayload("02"), "card-1")
+	testPostForAccountHelper(t, accountPayload("03"), "card-1")
+	testPostForAccountHelper(t, accountPayload("03"), "card-2")
+	testPostHelper(t, []byte(accountPayload("05")))
+
+	w := testGetAccountHelper(t, getAccountBalance, "/accounts/card-1/balance")
+	var br BalanceResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &br); err != nil || br.Balance != 68 || br.AccountId != "card-1" {
+		t.Errorf("Expected a balance of 68 but got %+v (error %v)", br, err)
+	}
+
+	if w := testGetAccountHelper(t, getAccountBalance, "/accounts/card-3/balance"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound for an unknown account but got %v", w.Code)
+	}
+
+}
+
+func TestAccountReceiptsPagination(t *testing.T) {
+
+	useFreshStore(t)
+
+	var ids []string
+	for _, day := range []string{"02", "05", "03"} {
+		ids = append(ids, testPostForAccountHelper(t, accountPayload(day), "card-1"))
+	}
+
+	// Most recent purchase first
+	expected := []string{ids[1], ids[2], ids[0]}
+	var got []string
+	target := "/accounts/card-1/receipts?limit=2"
+	for pages := 0; target != ""; pages++ {
+		if pages == 3 {
+			t.Fatalf("Too many pages")
+		}
+		w := testGetAccountHelper(t, getAccountReceipts, target)
+		var page ReceiptPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Invalid JSON on receipts: %s", err)
+		}
+		for _, summary := range page.Receipts {
+			got = append(got, summary.Id)
+		}
+		target = ""
+		if page.NextCursor != "" {
+			target = "/accounts/card-1/receipts?limit=2&cursor=" + page.NextCursor
+		}
+	}
+
+	if len(got) != 3 || got[0] != expected[0] || got[1] != expected[1] || got[2] != expected[2] {
+		t.Errorf("Expected %v but got %v", expected, got)
+	}
+
+	for _, target := range []string{
+		"/accounts/card-1/receipts?limit=0",
+		"/accounts/card-1/receipts?limit=1000",
+		"/accounts/card-1/receipts?cursor=nonsense",
+	} {
+		if w := testGetAccountHelper(t, getAccountReceipts, target); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected BadRequest for %s but got %v", target, w.Code)
+		}
+	}
+	if w := testGetAccountHelper(t, getAccountReceipts, "/accounts/card-2/receipts"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound for an unknown account but got %v", w.Code)
+	}
+
+}
+
+func TestInvalidAccountId(t *testing.T) {
+
+	useFreshStore(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewBufferString(accountPayload("02")))
+	req.Header.Set("Account-Id", "card 1; drop")
+	w := httptest.NewRecorder()
+	processReceipt(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected BadRequest but got %v", w.Code)
+	}
+	if ids, _ := store.List(); len(ids) != 0 {
+		t.Errorf("Receipt stored despite the invalid account")
+	}
+
+}
+
+// Redeems points from the account with the given If-Match header (if not
+// empty) and returns the recorded response
+func testRedeemHelper(t *testing.T, accountId string, ifMatch string, body string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodPost, "/accounts/"+accountId+"/redemptions", bytes.NewBufferString(body))
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	postRedemption(w, req)
+	return w
+
+}
+
+func TestRedemptions(t *testing.T) {
+
+	useFreshStore(t)
+	testPostForAccountHelper(t, accountPayload("02"), "card-1")
+	testPostForAccountHelper(t, accountPayload("03"), "card-1")
+
+	w := testGetAccountHelper(t, getAccountBalance, "/accounts/card-1/balance")
+	etag := w.Header().Get("ETag")
+	if etag != `"2"` {
+		t.Fatalf("Expected ETag \"2\" but got %s", etag)
+	}
+
+	cases := []struct {
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{"", `{"points": 10}`, http.StatusPreconditionRequired},
+		{`"1"`, `{"points": 10}`, http.StatusPreconditionFailed},
+		{etag, `{"points": 69}`, http.StatusUnprocessableEntity},
+		{etag, `{"points": -5}`, http.StatusBadRequest},
+		{etag, `{"points": 5, "extra": 1}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := testRedeemHelper(t, "card-1", c.ifMatch, c.body); w.Code != c.status {
+			t.Errorf("Expected %v for %s with If-Match %s but got %v: %s", c.status, c.body, c.ifMatch, w.Code, w.Body)
+		}
+	}
+	if w := testRedeemHelper(t, "card-9", `"0"`, `{"points": 1}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound for an unknown account but got %v", w.Code)
+	}
+
+	w = testRedeemHelper(t, "card-1", etag, `{"points": 50, "description": "Gift card"}`)
+	var rr RedemptionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rr); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected OK but got %v: %s", w.Code, w.Body)
+	}
+	if rr.Entry.Points != -50 || rr.Entry.Balance != 18 || w.Header().Get("ETag") != `"3"` {
+		t.Errorf("Unexpected redemption %+v with ETag %s", rr.Entry, w.Header().Get("ETag"))
+	}
+
+	// The same version can't be used twice
+	if w := testRedeemHelper(t, "card-1", etag, `{"points": 1}`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected PreconditionFailed reusing a version but got %v", w.Code)
+	}
+
+	w = testGetAccountHelper(t, getAccountLedger, "/accounts/card-1/ledger")
+	var lr LedgerResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &lr); err != nil {
+		t.Fatalf("Invalid JSON on ledger: %s", err)
+	}
+	sum := 0
+	for _, entry := range lr.Entries {
+		sum += entry.Points
+	}
+	if len(lr.Entries) != 3 || sum != lr.Balance || lr.Balance != 18 || lr.Version != 3 {
+		t.Errorf("Ledger doesn't add up: %+v", lr)
+	}
+
+}
+
+func TestConcurrentRedemptions(t *testing.T) {
+
+	useFreshStore(t)
+	testPostForAccountHelper(t, accountPayload("02"), "card-1")
+
+	// Every client read the balance at version 1, so only one may spend it
+	const clients = 16
+	var wg sync.WaitGroup
+	statuses := make(chan int, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- testRedeemHelper(t, "card-1", `"1"`, `{"points": 31}`).Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	if balance, _, _ := store.GetBalance("card-1"); succeeded != 1 || balance != 0 {
+		t.Errorf("Expected one redemption leaving 0 points but got %v leaving %v", succeeded, balance)
+	}
+
+}
+
+// Submits the payload for the account with the given Idempotency-Key (if any)
+// and returns the response's status code
+func testPostForAccountWithKeyHelper(t *testing.T, payload string, accountId string, key string) int {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewBufferString(payload))
+	req.Header.Set("Account-Id", accountId)
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	processReceipt(w, req)
+	return w.Code
+
+}
+
+func TestResubmissionForAnotherAccount(t *testing.T) {
+
+	useFreshStore(t)
+
+	if status := testPostForAccountWithKeyHelper(t, accountPayload("02"), "card-1", "key-1"); status != http.StatusOK {
+		t.Fatalf("Expected OK but got %v", status)
+	}
+	if status := testPostForAccountWithKeyHelper(t, accountPayload("02"), "card-1", "key-1"); status != http.StatusOK {
+		t.Errorf("Expected OK retrying for the same account but got %v", status)
+	}
+	if status := testPostForAccountWithKeyHelper(t, accountPayload("02"), "card-2", "key-1"); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected UnprocessableEntity reusing the key for another account but got %v", status)
+	}
+	if _, _, err := store.GetBalance("card-2"); !errors.Is(err, errAccountNotFound) {
+		t.Errorf("Expected the other account not to exist but got %v", err)
+	}
+
+}
+
+func TestContentIdForAnotherAccount(t *testing.T) {
+
+	useFreshStore(t)
+	useIdStrategy(t, idStrategyContent)
+
+	id := testPostForAccountHelper(t, accountPayload("02"), "card-1")
+	if status := testPostForAccountWithKeyHelper(t, accountPayload("02"), "card-1", ""); status != http.StatusOK {
+		t.Errorf("Expected OK for a copy on the same account but got %v", status)
+	}
+	if status := testPostForAccountWithKeyHelper(t, accountPayload("02"), "card-2", ""); status != http.StatusConflict {
+		t.Errorf("Expected Conflict for a copy on another account but got %v", status)
+	}
+
+	if _, err := store.Void(id, ReceiptVoid{Reason: "fraud", VoidedBy: "support-7"}); err != nil {
+		t.Fatal(err)
+	}
+	if status := testPostForAccountWithKeyHelper(t, accountPayload("02"), "card-1", ""); status != http.StatusConflict {
+		t.Errorf("Expected Conflict for a copy of a voided receipt but got %v", status)
+	}
+
+}
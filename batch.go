@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/*
+BatchResponse is the body returned for POST requests to /receipts/batch. There
+is one result per receipt in the batch, in the order they were submitted, so
+the response is a 200 even if every receipt was rejected.
+*/
+type BatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []BatchResult `json:"results"`
+}
+
+/*
+BatchResult is the outcome of one receipt in a batch. Status is the status
+code the receipt would have got on its own from /receipts/process. Id is set
+for stored receipts and for duplicates (where it is the original's ID),
+Errors for invalid receipts, and Message for anything else that went wrong.
+*/
+type BatchResult struct {
+	Index   int               `json:"index"`
+	Status  int               `json:"status"`
+	Id      string            `json:"id,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Errors  []ValidationError `json:"errors,omitempty"`
+}
+
+/*
+Handler for POST requests to /receipts/batch
+
+The body is either a JSON array of receipts or NDJSON (one receipt per line).
+Each receipt is validated, scored and stored just as it would be by
+/receipts/process, and a bad receipt only fails its own entry. Idempotency
+keys don't apply to batches, but duplicate detection and the Strict-JSON and
+Account-Id headers do. A body larger than maxBatchBytes is cut off, and the
+receipts after the cut are reported as a final entry with a 413.
+*/
+func processBatch(w http.ResponseWriter, req *http.Request) {
+
+	strict, ok := requestStrictness(w, req)
+	if !ok {
+		return
+	}
+	accountId, ok := requestAccount(w, req)
+	if !ok {
+		return
+	}
+	reader := bufio.NewReader(http.MaxBytesReader(w, req.Body, maxBatchBytes))
+
+	var results []BatchResult
+	if startsWithArray(reader) {
+		results = submitArrayBatch(reader, strict, accountId)
+	} else {
+		results = submitNDJSONBatch(reader, strict, accountId)
+	}
+
+	resp := BatchResponse{Results: results}
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+
+}
+
+// Reports whether the first non-whitespace byte waiting in the reader opens
+// a JSON array, without consuming it
+func startsWithArray(reader *bufio.Reader) bool {
+
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return b[0] == '['
+		}
+	}
+
+}
+
+// Submits each receipt in a JSON array, one element at a time. If the array
+// itself is malformed there's no telling where the next receipt starts, so
+// the problem is reported as the final entry and the rest of the body is
+// ignored. Receipts before it have already been stored, so the client still
+// needs their results.
+func submitArrayBatch(reader io.Reader, strict bool, accountId string) []BatchResult {
+
+	decoder := json.NewDecoder(reader)
+	results := []BatchResult{}
+	malformed := func(err error) []BatchResult {
+		if isReadError(err) {
+			return append(results, unreadableBatchEntry(len(results), err))
+		}
+		return append(results, BatchResult{
+			Index:  len(results),
+			Status: http.StatusBadRequest,
+			Errors: []ValidationError{describeJSONError(err)},
+		})
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return malformed(err)
+	}
+	for decoder.More() {
+		var entry json.RawMessage
+		if err := decoder.Decode(&entry); err != nil {
+			return malformed(err)
+		}
+		results = append(results, submitBatchEntry(len(results), entry, strict, accountId))
+	}
+	if _, err := decoder.Token(); err != nil {
+		return malformed(err)
+	}
+
+	return results
+
+}
+
+// Submits each line of an NDJSON body as a receipt. Blank lines are skipped,
+// and a line that isn't valid JSON only fails its own entry. If the body
+// can't be read to the end, that is reported as the final entry.
+func submitNDJSONBatch(reader *bufio.Reader, strict bool, accountId string) []BatchResult {
+
+	results := []BatchResult{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return append(results, unreadableBatchEntry(len(results), err))
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			results = append(results, submitBatchEntry(len(results), line, strict, accountId))
+		}
+		if err != nil {
+			return results
+		}
+	}
+
+}
+
+// The entry reported when the rest of a batch can't be read, either because
+// it's too large or because the connection failed
+func unreadableBatchEntry(index int, err error) BatchResult {
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return BatchResult{
+			Index:   index,
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("The rest of the batch is beyond the limit of %d bytes.", tooLarge.Limit),
+		}
+	}
+	return BatchResult{
+		Index:   index,
+		Status:  http.StatusBadRequest,
+		Message: "The rest of the batch could not be read.",
+	}
+
+}
+
+// Validates, scores and stores a single receipt from a batch
+func submitBatchEntry(index int, data []byte, strict bool, accountId string) BatchResult {
+
+	validReceipt, problems := parseReceipt(data, strict)
+	if len(problems) > 0 {
+		return BatchResult{Index: index, Status: http.StatusBadRequest, Errors: problems}
+	}
+
+	sub := submitReceipt(validReceipt, "", accountId)
+	result := BatchResult{Index: index, Status: sub.status, Id: sub.id}
+	if sub.status != http.StatusOK {
+		result.Message = sub.message
+	}
+	return result
+
+}
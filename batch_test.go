@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Sends the body to the batch endpoint and unpacks the response
+func testBatchHelper(t *testing.T, body string) BatchResponse {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/batch", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+
+	processBatch(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected OK but got %v: %s", resp.StatusCode, data)
+	}
+
+	var br BatchResponse
+	if err := json.Unmarshal(data, &br); err != nil {
+		t.Fatalf("Invalid JSON on batch: %s", err)
+	}
+	return br
+
+}
+
+const batchReceiptA = `{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]}`
+const batchReceiptB = `{"retailer": "a", "purchaseDate": "2025-01-03", "purchaseTime": "00:00", "total": "0.01", "items": [{"shortDescription": "item", "price": "0.01"}]}`
+const batchReceiptBad = `{"retailer": "Target<", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25", "items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}]}`
+
+func TestArrayBatch(t *testing.T) {
+
+	useFreshStore(t)
+
+	br := testBatchHelper(t, "["+batchReceiptA+","+batchReceiptBad+","+batchReceiptB+"]")
+	if br.Accepted != 2 || br.Rejected != 1 || len(br.Results) != 3 {
+		t.Fatalf("Unexpected batch response: %+v", br)
+	}
+
+	bad := br.Results[1]
+	if bad.Index != 1 || bad.Status != http.StatusBadRequest || bad.Id != "" ||
+		len(bad.Errors) != 1 || bad.Errors[0].Path != "/retailer" {
+		t.Errorf("Unexpected result for the invalid receipt: %+v", bad)
+	}
+
+	// The accepted receipts were scored and stored as usual
+	for i, expected := range map[int]int{0: 31, 2: 7} {
+		if points, err := store.GetPoints(br.Results[i].Id); err != nil || points != expected {
+			t.Errorf("Entry %d: expected %v points but got %v (error %v)", i, expected, points, err)
+		}
+	}
+
+}
+
+func TestNDJSONBatch(t *testing.T) {
+
+	useFreshStore(t)
+
+	br := testBatchHelper(t, batchReceiptA+"\n\n"+`{"retailer": `+"\n"+batchReceiptB)
+	if br.Accepted != 2 || br.Rejected != 1 || len(br.Results) != 3 {
+		t.Fatalf("Unexpected batch response: %+v", br)
+	}
+	if malformed := br.Results[1]; malformed.Status != http.StatusBadRequest ||
+		malformed.Errors[0].Code != "truncated_json" {
+		t.Errorf("Unexpected result for the malformed line: %+v", malformed)
+	}
+	if ids, _ := store.List(); len(ids) != 2 {
+		t.Errorf("Expected 2 stored receipts but got %v", len(ids))
+	}
+
+}
+
+func TestBatchDuplicates(t *testing.T) {
+
+	useFreshStore(t)
+	detectDuplicates = true
+	t.Cleanup(func() { detectDuplicates = false })
+
+	br := testBatchHelper(t, "["+batchReceiptA+","+batchReceiptA+"]")
+	if dup := br.Results[1]; dup.Status != http.StatusConflict || dup.Id != br.Results[0].Id {
+		t.Errorf("Expected a conflict with ID %v but got %+v", br.Results[0].Id, dup)
+	}
+
+}
+
+func TestMalformedArrayBatch(t *testing.T) {
+
+	useFreshStore(t)
+
+	// The receipt before the array breaks off is still stored, and the client
+	// learns its ID
+	br := testBatchHelper(t, "["+batchReceiptA+", {")
+	if br.Accepted != 1 || br.Rejected != 1 || len(br.Results) != 2 {
+		t.Fatalf("Unexpected batch response: %+v", br)
+	}
+	if malformed := br.Results[1]; malformed.Status != http.StatusBadRequest ||
+		malformed.Errors[0].Code != "truncated_json" {
+		t.Errorf("Unexpected result for the malformed tail: %+v", malformed)
+	}
+
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Besides running the server, the binary has subcommands for working with the
+stored receipts directly:
+
+	receipt_processor import [flags] [file.ndjson ...]
+	receipt_processor export [flags]
+	receipt_processor score [flags] receipt.json ...
+
+Import and export read and write a line at a time, so the NDJSON file itself
+is never held in memory. The receipts are, though: every store keeps a full
+copy of them in memory, and the file store replays its whole log on opening.
+
+Import accepts both receipts as they would be POSTed and the lines written by
+export, so an export can be imported into another store to copy it.
+*/
+
+// Adds the flags choosing where receipts are kept, with the given default
+// kind of store, and returns pointers to their values
+func addStoreFlags(flags *flag.FlagSet, defaultKind string) (*string, *string) {
+
+	storeKind := flags.String("store", defaultKind, "where receipts are kept: \"memory\" or \"file\"")
+	storePath := flags.String("store-path", "receipts.log", "path to the receipt log used by the file store")
+	return storeKind, storePath
+
+}
+
+// Adds the flags controlling how newly submitted receipts are checked, scored
+// and identified
+func addScoringFlags(flags *flag.FlagSet) {
+
+	addRulesFlag(flags)
+	addStrictFlag(flags)
+	flags.BoolVar(&detectDuplicates, "detect-duplicates", false, "reject receipts whose contents match one already stored")
+	flags.StringVar(&idStrategy, "id-strategy", idStrategyRandom,
+		"how receipt IDs are generated: \"random\" (UUIDv4), \"time\" (UUIDv7) or \"content\" (UUIDv5)")
+	flags.StringVar(&totalPolicy, "total-policy", totalPolicyWarn,
+		"what to do when a receipt's total doesn't match its items: \"warn\", \"tolerance\" or \"strict\"")
+	flags.StringVar(&totalTolerance, "total-tolerance", "0.00",
+		"difference allowed by -total-policy tolerance, as an amount like \"2.00\" or a percentage like \"15%\"")
+
+}
+
+// Adds the flag choosing the scoring rules
+func addRulesFlag(flags *flag.FlagSet) {
+	flags.StringVar(&rulesPath, "rules", "", "path to a JSON file configuring the scoring rules")
+}
+
+// Checks the scoring flags and loads the rules they point at
+func setUpScoring() error {
+
+	if err := validateIdStrategy(idStrategy); err != nil {
+		return err
+	}
+	if err := validateTotalPolicy(totalPolicy, totalTolerance); err != nil {
+		return err
+	}
+	if rulesPath != "" {
+		set, err := reloadRules()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Loaded scoring rules version %d from %s.\n", set.version, set.source)
+	}
+	return nil
+
+}
+
+// Opens the store chosen by the store flags and makes it the one in use
+func setUpStore(kind string, path string) error {
+
+	opened, err := openStore(kind, path)
+	if err != nil {
+		return err
+	}
+	store = opened
+	return nil
+
+}
+
+// Runs the import subcommand, which stores each receipt in the given NDJSON
+// files (or standard input if there are none), either as if it had been
+// POSTed to /receipts/process or as it was exported (see importLine).
+// Problems with individual receipts are reported on standard error. Returns
+// the exit status, which is 1 if any receipt was rejected.
+func runImport(args []string) int {
+
+	flags := flag.NewFlagSet("receipt_processor import", flag.ExitOnError)
+	storeKind, storePath := addStoreFlags(flags, "file")
+	addScoringFlags(flags)
+	addLimitFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: receipt_processor import [flags] [file.ndjson ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *storeKind == "memory" {
+		fmt.Fprintln(os.Stderr, "Importing into the memory store would lose every receipt on exit; use -store file.")
+		return 2
+	}
+	if err := validateLimits(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := setUpScoring(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := setUpStore(*storeKind, *storePath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	accepted, rejected := 0, 0
+	for _, input := range inputs {
+		a, r, err := importFile(input, os.Stderr)
+		accepted += a
+		rejected += r
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			rejected++
+			break
+		}
+	}
+
+	if err := store.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d receipts, rejected %d.\n", accepted, rejected)
+	if rejected > 0 {
+		return 1
+	}
+	return 0
+
+}
+
+// Imports each line of the named NDJSON file, or of standard input if the
+// name is "-", reporting rejected receipts to report. Returns the number of
+// receipts accepted and rejected.
+func importFile(name string, report io.Writer) (int, int, error) {
+
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer file.Close()
+		input = file
+	} else {
+		name = "stdin"
+	}
+
+	return importReceipts(bufio.NewReader(input), name, report)
+
+}
+
+// Imports each line of NDJSON from reader (see importLine). Blank lines are
+// skipped.
+func importReceipts(reader *bufio.Reader, name string, report io.Writer) (int, int, error) {
+
+	accepted, rejected := 0, 0
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return accepted, rejected, fmt.Errorf("%s: reading line %d: %w", name, lineNumber, err)
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			sub := importLine(line)
+			if sub.status == http.StatusOK {
+				accepted++
+			} else {
+				rejected++
+				reportRejection(report, fmt.Sprintf("%s:%d", name, lineNumber), sub)
+			}
+		}
+
+		if err != nil {
+			return accepted, rejected, nil
+		}
+	}
+
+}
+
+/*
+Imports a single line. A line holding a receipt is validated, scored and
+stored exactly as if it had been POSTed to /receipts/process. A line written
+by export (recognised by its "receipt" field) is restored as it was exported
+instead: its receipt is validated, but keeps its ID, points, breakdown,
+account, idempotency key and void rather than being scored again. Either way
+the receipt is held to the limits set by -max-body-bytes and -max-items.
+*/
+func importLine(line []byte) submission {
+
+	var envelope struct {
+		Receipt json.RawMessage `json:"receipt"`
+	}
+	if json.Unmarshal(line, &envelope) == nil && envelope.Receipt != nil {
+		if int64(len(envelope.Receipt)) > maxBodyBytes {
+			return receiptTooLarge()
+		}
+		return restoreReceipt(line, envelope.Receipt)
+	}
+
+	if int64(len(bytes.TrimSpace(line))) > maxBodyBytes {
+		return receiptTooLarge()
+	}
+	validReceipt, problems := parseReceipt(line, strictJSON)
+	if len(problems) > 0 {
+		return submission{status: http.StatusBadRequest, problems: problems}
+	}
+	return submitReceipt(validReceipt, "", "")
+
+}
+
+// The submission for a receipt larger than -max-body-bytes allows
+func receiptTooLarge() submission {
+	return submission{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("The receipt is larger than the limit of %d bytes.", maxBodyBytes)}
+}
+
+// Restores a receipt from a line written by export. The receipt itself is
+// given separately, as it was written, so that it can be checked strictly.
+func restoreReceipt(line []byte, rawReceipt []byte) submission {
+
+	var exported ExportedReceipt
+	if err := json.Unmarshal(line, &exported); err != nil {
+		return submission{status: http.StatusBadRequest, message: fmt.Sprintf("The exported receipt is not valid: %s", err)}
+	}
+	validReceipt, problems := parseReceipt(rawReceipt, strictJSON)
+	if len(problems) > 0 {
+		return submission{status: http.StatusBadRequest, problems: problems}
+	}
+
+	switch {
+	case exported.Id == "":
+		return submission{status: http.StatusBadRequest, message: "The exported receipt has no ID."}
+	case exported.AccountId != "" && !accountIdRegex.MatchString(exported.AccountId):
+		return submission{status: http.StatusBadRequest, message: fmt.Sprintf("The account ID %q is not valid.", exported.AccountId)}
+	}
+
+	// Restoring over a receipt that is already stored would credit its account
+	// a second time
+	if _, err := store.Get(exported.Id); err == nil {
+		return submission{status: http.StatusConflict, id: exported.Id, message: "A receipt with this ID is already stored."}
+	}
+	if exported.IdempotencyKey != "" {
+		if priorId, err := store.FindByIdempotencyKey(exported.IdempotencyKey); err == nil {
+			return submission{status: http.StatusConflict, id: priorId, message: "The receipt's idempotency key is already used by another receipt."}
+		}
+	}
+
+	strategy := exported.IdStrategy
+	if strategy == "" {
+		strategy = idStrategyRandom
+	}
+	err := store.Save(exported.Id, scoredReceipt{
+		receipt:        validReceipt,
+		points:         exported.Points,
+		breakdown:      exported.Breakdown,
+		ruleSetVersion: exported.RuleSetVersion,
+		idempotencyKey: exported.IdempotencyKey,
+		contentHash:    contentHash(validReceipt),
+		idStrategy:     strategy,
+		accountId:      exported.AccountId,
+	})
+	if err == nil && exported.Void != nil {
+		_, err = store.Void(exported.Id, *exported.Void)
+	}
+	if err != nil {
+		return submission{status: http.StatusInternalServerError, message: "The receipt could not be saved."}
+	}
+	return submission{status: http.StatusOK, id: exported.Id}
+
+}
+
+// Writes a line describing why a receipt was rejected, followed by a line for
+// each validation problem
+func reportRejection(report io.Writer, where string, sub submission) {
+
+	switch {
+	case len(sub.problems) > 0:
+		fmt.Fprintf(report, "%s: The receipt is invalid.\n", where)
+		for _, problem := range sub.problems {
+			fmt.Fprintf(report, "  %s: %s (%s)\n", problem.Path, problem.Message, problem.Code)
+		}
+	case sub.id != "":
+		fmt.Fprintf(report, "%s: %s (%s)\n", where, sub.message, sub.id)
+	default:
+		fmt.Fprintf(report, "%s: %s\n", where, sub.message)
+	}
+
+}
+
+/*
+ExportedReceipt is a single line written by the export subcommand: a stored
+receipt in the same shape in which it was submitted, alongside everything
+else the store keeps about it. Void is only present if the receipt has been
+voided.
+
+Accounts' ledgers aren't exported. Importing an export credits each account
+with its receipts' points again, and reverses those of voided receipts, but
+redemptions and expiries have to be carried over some other way.
+*/
+type ExportedReceipt struct {
+	Id             string       `json:"id"`
+	Points         int          `json:"points"`
+	RuleSetVersion int          `json:"ruleSetVersion"`
+	Breakdown      []RuleResult `json:"breakdown"`
+	IdStrategy     string       `json:"idStrategy,omitempty"`
+	AccountId      string       `json:"accountId,omitempty"`
+	IdempotencyKey string       `json:"idempotencyKey,omitempty"`
+	Receipt        RawReceipt   `json:"receipt"`
+	Void           *ReceiptVoid `json:"void,omitempty"`
+}
+
+// Runs the export subcommand, which writes every stored receipt to standard
+// output (or the file named by -o) as NDJSON. Returns the exit status.
+func runExport(args []string) int {
+
+	flags := flag.NewFlagSet("receipt_processor export", flag.ExitOnError)
+	storeKind, storePath := addStoreFlags(flags, "file")
+	outputPath := flags.String("o", "-", "file to write the receipts to, or - for standard output")
+	flags.Parse(args)
+
+	if err := setUpStore(*storeKind, *storePath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer store.Close()
+
+	var output io.Writer = os.Stdout
+	if *outputPath != "-" {
+		file, err := os.Create(*outputPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		output = file
+	}
+
+	buffered := bufio.NewWriter(output)
+	count, err := exportReceipts(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d receipts.\n", count)
+	return 0
+
+}
+
+// Writes each stored receipt to output as a line of JSON. The IDs are listed
+// up front, and the receipts fetched from the store one at a time. Returns
+// the number of receipts written.
+func exportReceipts(output io.Writer) (int, error) {
+
+	ids, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(output)
+	count := 0
+	for _, id := range ids {
+		scored, err := store.Get(id)
+		if errors.Is(err, errReceiptNotFound) {
+			// Deleted since the list was taken
+			continue
+		} else if err != nil {
+			return count, err
+		}
+
+		err = encoder.Encode(ExportedReceipt{
+			Id:             id,
+			Points:         scored.points,
+			RuleSetVersion: scored.ruleSetVersion,
+			Breakdown:      scored.breakdown,
+			IdStrategy:     scored.idStrategy,
+			AccountId:      scored.accountId,
+			IdempotencyKey: scored.idempotencyKey,
+			Receipt:        scored.receipt.toRaw(),
+			Void:           scored.void,
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+
+}
+
+// Runs the score subcommand, which prints the points and breakdown each of the
+// given receipt files would earn, without storing them. Arguments may be glob
+// patterns, and "-" reads a receipt from standard input. Receipts are checked
+// against the same flags and limits as the server's, so that a receipt the
+// server would reject is rejected here too. Returns the exit status, which is
+// 1 if any receipt was invalid or couldn't be read.
+func runScore(args []string) int {
+
+	flags := flag.NewFlagSet("receipt_processor score", flag.ExitOnError)
+	addScoringFlags(flags)
+	addLimitFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: receipt_processor score [flags] receipt.json ...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := validateLimits(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := setUpScoring(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	failed := false
+	for _, pattern := range flags.Args() {
+		names, err := expandPattern(pattern)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		for _, name := range names {
+			if !scoreFile(name, os.Stdout, os.Stderr) {
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+
+}
+
+// Returns the files matching a glob pattern. A pattern without any glob
+// characters is returned as is, so that a missing file is reported when it
+// is opened rather than silently matching nothing.
+func expandPattern(pattern string) ([]string, error) {
+
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pattern, err)
+	}
+	if len(names) == 0 {
+		if !strings.ContainsAny(pattern, "*?[") {
+			return []string{pattern}, nil
+		}
+		return nil, fmt.Errorf("%s: no files match", pattern)
+	}
+	return names, nil
+
+}
+
+// Scores the receipt in the named file, or on standard input if the name is
+// "-", and writes its points and breakdown to output. Problems are written to
+// report instead. Returns whether the receipt was scored.
+func scoreFile(name string, output io.Writer, report io.Writer) bool {
+
+	var data []byte
+	var err error
+	if name == "-" {
+		name = "stdin"
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		fmt.Fprintln(report, err)
+		return false
+	}
+	if int64(len(data)) > maxBodyBytes {
+		fmt.Fprintf(report, "%s: The receipt is larger than the limit of %d bytes.\n", name, maxBodyBytes)
+		return false
+	}
+
+	validReceipt, problems := parseReceipt(data, strictJSON)
+	if len(problems) > 0 {
+		reportRejection(report, name, submission{problems: problems})
+		return false
+	}
+
+	rules := activeRules.Load()
+	points, breakdown := rules.registry.Breakdown(validReceipt)
+	fmt.Fprintf(output, "%s: %d points (rule set version %d)\n", name, points, rules.version)
+	for _, result := range breakdown {
+		fmt.Fprintf(output, "  %-22s %4d  %s\n", result.Rule, result.Points, result.Reason)
+	}
+	if discrepancy := totalDiscrepancy(validReceipt); discrepancy != nil {
+		fmt.Fprintf(output, "  warning: total of %s doesn't match the items' sum of %s\n",
+			discrepancy.Total, discrepancy.ItemsTotal)
+	}
+	return true
+
+}
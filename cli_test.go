@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportAndExport(t *testing.T) {
+
+	useFreshStore(t)
+
+	input := batchReceiptA + "\n\n" + batchReceiptBad + "\n" + batchReceiptB
+	var report bytes.Buffer
+	accepted, rejected, err := importReceipts(bufio.NewReader(strings.NewReader(input)), "test", &report)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if accepted != 2 || rejected != 1 {
+		t.Errorf("Expected 2 accepted and 1 rejected but got %v and %v", accepted, rejected)
+	}
+	// The rejected receipt is on line 3, counting the blank line
+	if !strings.Contains(report.String(), "test:3: The receipt is invalid.") ||
+		!strings.Contains(report.String(), "/retailer") {
+		t.Errorf("Rejection not reported as expected: %q", report.String())
+	}
+
+	var output bytes.Buffer
+	count, err := exportReceipts(&output)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 receipts exported but got %v (error %v)", count, err)
+	}
+
+	points := map[string]int{}
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var exported ExportedReceipt
+		if err := decoder.Decode(&exported); err != nil {
+			t.Fatalf("Invalid JSON on export: %s", err)
+		}
+		if stored, _ := store.GetPoints(exported.Id); stored != exported.Points {
+			t.Errorf("Exported %v points for %s but %v are stored", exported.Points, exported.Id, stored)
+		}
+		points[exported.Receipt.Retailer] = exported.Points
+	}
+	if points["Target"] != 31 || points["a"] != 7 {
+		t.Errorf("Expected Target: 31 and a: 7 but got %v", points)
+	}
+
+}
+
+func TestExportRoundTrip(t *testing.T) {
+
+	useFreshStore(t)
+
+	validReceipt, _ := parseReceipt([]byte(batchReceiptA), false)
+	kept := submitReceipt(validReceipt, "key-1", "card-1").id
+	validReceipt, _ = parseReceipt([]byte(accountPayload("03")), false)
+	voided := submitReceipt(validReceipt, "", "card-1").id
+	void := ReceiptVoid{Reason: "returned", VoidedBy: "clerk", VoidedAt: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)}
+	if _, err := store.Void(voided, void); err != nil {
+		t.Fatal(err)
+	}
+	original := map[string]scoredReceipt{}
+	for _, id := range []string{kept, voided} {
+		original[id], _ = store.Get(id)
+	}
+
+	var output bytes.Buffer
+	if count, err := exportReceipts(&output); err != nil || count != 2 {
+		t.Fatalf("Expected 2 receipts exported but got %v (error %v)", count, err)
+	}
+	exported := output.String()
+
+	// Importing the export into an empty store brings every receipt back as
+	// it was
+	useFreshStore(t)
+	var report bytes.Buffer
+	accepted, rejected, err := importReceipts(bufio.NewReader(strings.NewReader(exported)), "export", &report)
+	if err != nil || accepted != 2 || rejected != 0 {
+		t.Fatalf("Expected 2 accepted but got %v accepted, %v rejected (error %v): %s", accepted, rejected, err, report.String())
+	}
+	for id, want := range original {
+		if got, err := store.Get(id); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Receipt %s not restored intact: got %+v, want %+v (error %v)", id, got, want, err)
+		}
+	}
+	if id, _ := store.FindByIdempotencyKey("key-1"); id != kept {
+		t.Errorf("Expected the idempotency key to find %s but got %v", kept, id)
+	}
+	if balance, _, _ := store.GetBalance("card-1"); balance != 31 {
+		t.Errorf("Expected the account to hold the unvoided receipt's 31 points but got %v", balance)
+	}
+
+	// Importing it again would credit the account twice
+	accepted, rejected, _ = importReceipts(bufio.NewReader(strings.NewReader(exported)), "export", &report)
+	if accepted != 0 || rejected != 2 || !strings.Contains(report.String(), "already stored") {
+		t.Errorf("Expected both receipts to be rejected the second time but got %v accepted: %s", accepted, report.String())
+	}
+
+}
+
+func TestImportWithoutTrailingNewline(t *testing.T) {
+
+	useFreshStore(t)
+
+	accepted, rejected, err := importReceipts(bufio.NewReader(strings.NewReader(batchReceiptA)), "test", &bytes.Buffer{})
+	if err != nil || accepted != 1 || rejected != 0 {
+		t.Errorf("Expected 1 accepted but got %v accepted, %v rejected (error %v)", accepted, rejected, err)
+	}
+
+}
+
+func TestImportLimits(t *testing.T) {
+
+	useFreshStore(t)
+	twoItems := `{"retailer": "a", "purchaseDate": "2025-01-03", "purchaseTime": "00:00", "total": "0.02", "items": [{"shortDescription": "item", "price": "0.01"}, {"shortDescription": "item", "price": "0.01"}]}`
+	validReceipt, _ := parseReceipt([]byte(twoItems), false)
+	submitReceipt(validReceipt, "", "")
+	var output bytes.Buffer
+	if _, err := exportReceipts(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both kinds of line are held to the limits
+	for _, line := range []string{twoItems, output.String()} {
+		t.Run("max-items", func(t *testing.T) {
+			useFreshStore(t)
+			useLimit(t, &maxItems, 1)
+			accepted, _, _ := importReceipts(bufio.NewReader(strings.NewReader(line)), "test", &bytes.Buffer{})
+			if accepted != 0 {
+				t.Errorf("Expected %s to be rejected for its items", line)
+			}
+		})
+		t.Run("max-body-bytes", func(t *testing.T) {
+			useFreshStore(t)
+			useLimit(t, &maxBodyBytes, 100)
+			var report bytes.Buffer
+			accepted, _, _ := importReceipts(bufio.NewReader(strings.NewReader(line)), "test", &report)
+			if accepted != 0 || !strings.Contains(report.String(), "larger than the limit of 100 bytes") {
+				t.Errorf("Expected %s to be rejected for its size but got %q", line, report.String())
+			}
+		})
+	}
+
+}
+
+func TestScoreFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"a.json":   batchReceiptA,
+		"b.json":   batchReceiptB,
+		"bad.json": batchReceiptBad,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := expandPattern(filepath.Join(dir, "*.json"))
+	if err != nil || len(names) != 3 {
+		t.Fatalf("Expected 3 files matched but got %v (error %v)", names, err)
+	}
+	if _, err := expandPattern(filepath.Join(dir, "*.txt")); err == nil {
+		t.Errorf("A pattern matching nothing should be an error")
+	}
+	if names, _ := expandPattern(filepath.Join(dir, "missing.json")); len(names) != 1 {
+		t.Errorf("A plain file name should be passed through but got %v", names)
+	}
+
+	var output, report bytes.Buffer
+	if !scoreFile(filepath.Join(dir, "a.json"), &output, &report) {
+		t.Fatalf("Valid receipt not scored: %s", report.String())
+	}
+	if !strings.Contains(output.String(), "a.json: 31 points") || !strings.Contains(output.String(), "afternoonBonus") {
+		t.Errorf("Unexpected output: %q", output.String())
+	}
+
+	output.Reset()
+	if scoreFile(filepath.Join(dir, "bad.json"), &output, &report) {
+		t.Errorf("Invalid receipt should not be scored")
+	}
+	if output.Len() != 0 || !strings.Contains(report.String(), "/retailer") {
+		t.Errorf("Validation errors not reported as expected: %q", report.String())
+	}
+
+	report.Reset()
+	if scoreFile(filepath.Join(dir, "missing.json"), &output, &report) || report.Len() == 0 {
+		t.Errorf("Missing file should be reported")
+	}
+
+}
+
+func TestScoreFileLimits(t *testing.T) {
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.json")
+	mismatched := filepath.Join(dir, "mismatched.json")
+	if err := os.WriteFile(name, []byte(batchReceiptA), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mismatched, mismatchedPayload("12.00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each receipt is turned away under a setting the server applies too
+	cases := []struct {
+		setting string
+		file    string
+		apply   func(t *testing.T)
+	}{
+		{"max-items", name, func(t *testing.T) { useLimit(t, &maxItems, 0) }},
+		{"max-body-bytes", name, func(t *testing.T) { useLimit(t, &maxBodyBytes, 64) }},
+		{"total-policy", mismatched, func(t *testing.T) { useTotalPolicy(t, totalPolicyStrict, "0.00") }},
+	}
+	for _, c := range cases {
+		t.Run(c.setting, func(t *testing.T) {
+			var output, report bytes.Buffer
+			if !scoreFile(c.file, &output, &report) {
+				t.Fatalf("Expected the receipt to be scored by default: %s", report.String())
+			}
+			c.apply(t)
+			output.Reset()
+			if scoreFile(c.file, &output, &report) || report.Len() == 0 {
+				t.Errorf("Expected the receipt to be rejected under %s but got %q", c.setting, output.String())
+			}
+		})
+	}
+
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Whether a receipt whose contents match one already stored is turned away
+// with a 409. Set with the -detect-duplicates flag.
+var detectDuplicates bool
+
+/*
+Submissions are serialised per idempotency key and per content hash, so that
+two copies of the same receipt arriving at once can't both be stored. The
+keys and hashes are spread over a fixed set of locks, and submissions that
+share none of them proceed in parallel.
+*/
+var submissionLocks [64]sync.Mutex
+
+// Takes the locks covering the given idempotency key and content hash (either
+// of which may be empty) and returns a func that releases them. Locks are
+// always taken in ascending order so that two submissions can't deadlock.
+func lockSubmission(key string, hash string) func() {
+
+	stripes := make(map[int]bool)
+	for _, s := range []string{key, hash} {
+		if s == "" {
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(s))
+		stripes[int(h.Sum32()%uint32(len(submissionLocks)))] = true
+	}
+
+	var order []int
+	for stripe := range stripes {
+		order = append(order, stripe)
+	}
+	sort.Ints(order)
+	for _, stripe := range order {
+		submissionLocks[stripe].Lock()
+	}
+
+	return func() {
+		for _, stripe := range order {
+			submissionLocks[stripe].Unlock()
+		}
+	}
+
+}
+
+// Serialises the parts of a receipt that identify it, always in the same
+// way, so that copies of the same receipt produce the same bytes
+func canonicalReceipt(r receipt) []byte {
+
+	type canonicalItem struct {
+		ShortDescription string `json:"shortDescription"`
+		Cents            int    `json:"cents"`
+	}
+	canonical := struct {
+		Retailer         string          `json:"retailer"`
+		PurchaseDatetime string          `json:"purchaseDatetime"`
+		Items            []canonicalItem `json:"items"`
+		Cents            int             `json:"cents"`
+	}{
+		Retailer:         r.retailer,
+		PurchaseDatetime: r.purchaseDatetime.Format("2006-01-02T15:04"),
+		Items:            make([]canonicalItem, 0, len(r.items)),
+		Cents:            r.cents,
+	}
+	for _, item := range r.items {
+		canonical.Items = append(canonical.Items, canonicalItem{
+			ShortDescription: item.shortDescription,
+			Cents:            item.cents,
+		})
+	}
+
+	data, _ := json.Marshal(canonical)
+	return data
+
+}
+
+// Returns a hex-encoded SHA-256 hash of the receipt's canonical form
+func contentHash(r receipt) string {
+
+	sum := sha256.Sum256(canonicalReceipt(r))
+	return hex.EncodeToString(sum[:])
+
+}
+
+// DuplicateResponse is the body sent along with a 409 for a duplicate receipt
+type DuplicateResponse struct {
+	Id      string `json:"id"`
+	Message string `json:"message"`
+}
+
+/*
+Checks whether a submission repeats one already stored, and if so returns the
+answer the client should get.
+
+A request carrying an Idempotency-Key that has been seen before is answered
+with the original receipt's ID, exactly as if it had just been stored, unless
+the key was used for a different receipt or on behalf of a different account,
+since the account named by the retry would never be credited. Otherwise, if
+duplicate detection is on, a receipt matching a stored one gets a 409
+carrying the original ID.
+*/
+func findResubmission(key string, hash string, accountId string) (submission, bool) {
+
+	readFailure := submission{status: http.StatusInternalServerError, message: "The receipt could not be read."}
+
+	if key != "" {
+		priorId, err := store.FindByIdempotencyKey(key)
+		if err == nil {
+			prior, err := store.Get(priorId)
+			if err != nil {
+				return readFailure, true
+			}
+			if prior.contentHash != hash {
+				return submission{
+					status:  http.StatusUnprocessableEntity,
+					message: "The Idempotency-Key has already been used for a different receipt.",
+				}, true
+			}
+			if prior.accountId != accountId {
+				return submission{
+					status:  http.StatusUnprocessableEntity,
+					message: "The Idempotency-Key has already been used for a receipt on a different account.",
+				}, true
+			}
+			return submission{status: http.StatusOK, id: priorId}, true
+		} else if !errors.Is(err, errReceiptNotFound) {
+			return readFailure, true
+		}
+	}
+
+	if detectDuplicates {
+		priorId, err := store.FindByContentHash(hash)
+		if err == nil {
+			return submission{
+				status:  http.StatusConflict,
+				id:      priorId,
+				message: "This receipt has already been submitted.",
+			}, true
+		} else if !errors.Is(err, errReceiptNotFound) {
+			return readFailure, true
+		}
+	}
+
+	return submission{}, false
+
+}
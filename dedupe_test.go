@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+var dedupePayload = []byte(`{
+	"retailer": "Walgreens",
+	"purchaseDate": "2022-01-02",
+	"purchaseTime": "08:13",
+	"total": "2.65",
+	"items": [
+		{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+		{"shortDescription": "Dasani", "price": "1.40"}
+	]
+}`)
+
+// Sends the payload in via a POST request with the given Idempotency-Key
+// (if any) and returns the response's status code and ID
+func testPostWithKeyHelper(t *testing.T, payload []byte, key string) (int, string) {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewBuffer(payload))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+
+	processReceipt(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+
+	var pr ProcessResponse
+	json.Unmarshal(data, &pr)
+	return resp.StatusCode, pr.Id
+
+}
+
+func TestIdempotencyKey(t *testing.T) {
+
+	useFreshStore(t)
+
+	status, first := testPostWithKeyHelper(t, dedupePayload, "retry-me")
+	if status != http.StatusOK || first == "" {
+		t.Fatalf("Expected OK with an ID but got %v", status)
+	}
+
+	// A retry with the same key gets the same ID, and nothing new is stored
+	status, second := testPostWithKeyHelper(t, dedupePayload, "retry-me")
+	if status != http.StatusOK || second != first {
+		t.Errorf("Expected OK with ID %v but got %v with ID %v", first, status, second)
+	}
+	if ids, _ := store.List(); len(ids) != 1 {
+		t.Errorf("Expected 1 stored receipt but got %v", len(ids))
+	}
+
+	// Without a key, or with a different one, the receipt is stored again
+	if _, id := testPostWithKeyHelper(t, dedupePayload, ""); id == first {
+		t.Errorf("Receipt without a key should get a new ID")
+	}
+	if _, id := testPostWithKeyHelper(t, dedupePayload, "another"); id == first {
+		t.Errorf("Receipt with a new key should get a new ID")
+	}
+
+}
+
+func TestIdempotencyKeyReusedForDifferentReceipt(t *testing.T) {
+
+	useFreshStore(t)
+
+	testPostWithKeyHelper(t, dedupePayload, "reused")
+	different := bytes.Replace(dedupePayload, []byte("Walgreens"), []byte("Target"), 1)
+	if status, _ := testPostWithKeyHelper(t, different, "reused"); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected UnprocessableEntity but got %v", status)
+	}
+
+}
+
+func TestConcurrentIdempotentRetries(t *testing.T) {
+
+	useFreshStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testPostWithKeyHelper(t, dedupePayload, "racing")
+		}()
+	}
+	wg.Wait()
+
+	if ids, _ := store.List(); len(ids) != 1 {
+		t.Errorf("Expected 1 stored receipt but got %v", len(ids))
+	}
+
+}
+
+func TestDuplicateDetection(t *testing.T) {
+
+	useFreshStore(t)
+	detectDuplicates = true
+	t.Cleanup(func() { detectDuplicates = false })
+
+	_, first := testPostWithKeyHelper(t, dedupePayload, "")
+
+	// Whitespace in the JSON doesn't change the receipt's contents
+	compact := new(bytes.Buffer)
+	json.Compact(compact, dedupePayload)
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", compact)
+	w := httptest.NewRecorder()
+
+	processReceipt(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+	var dr DuplicateResponse
+	if err := json.Unmarshal(data, &dr); err != nil {
+		t.Fatalf("Invalid JSON on POST: %s", err)
+	}
+	if resp.StatusCode != http.StatusConflict || dr.Id != first {
+		t.Errorf("Expected Conflict with ID %v but got %v with ID %v", first, resp.StatusCode, dr.Id)
+	}
+
+	// A different receipt is unaffected
+	different := bytes.Replace(dedupePayload, []byte("08:13"), []byte("08:14"), 1)
+	if status, _ := testPostWithKeyHelper(t, different, ""); status != http.StatusOK {
+		t.Errorf("Expected OK but got %v", status)
+	}
+
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Points can be set to expire in two ways, each given as a period like "12mo",
+"90d" or "1y":
+
+  - -expire-after: the points earned by a receipt expire that long after the
+    receipt's purchase date and time
+  - -expire-inactive-after: every point in an account expires once that long
+    has passed without the account earning or redeeming any
+
+Either, both or neither may be set, and when both are the earlier expiry
+applies. Expiration is worked out from the ledger alone: each lot of points
+(see ledger.go) expires with its receipt, and since lots are spent oldest
+first, redemptions spend the points closest to expiring.
+
+Points aren't taken away the moment they expire: a sweeper running every
+-expiry-sweep-interval posts an expiry entry to each account with points past
+their expiry. Until it does, those points can still be redeemed.
+*/
+const (
+	expiryReasonAge        = "age"
+	expiryReasonInactivity = "inactivity"
+)
+
+// The expiry periods as given on the command line, which are empty if points
+// don't expire that way, and how often to look for expired points
+var expireAfter = ""
+var expireInactiveAfter = ""
+var expirySweepInterval = time.Hour
+
+// The policy parsed from the flags above by setUpExpiry
+var expiry expiryPolicy
+
+// A calendar period, added to times with AddDate so that "12mo" always lands
+// on the same day of the month
+type period struct {
+	years, months, days int
+}
+
+var periodRegex = regexp.MustCompile(`^(\d+)(d|mo|y)$`)
+
+// Parses a period like "90d", "12mo" or "1y". The empty string is the zero
+// period.
+func parsePeriod(s string) (period, error) {
+
+	if s == "" {
+		return period{}, nil
+	}
+	match := periodRegex.FindStringSubmatch(s)
+	if match == nil {
+		return period{}, fmt.Errorf("period %q must be a number of days, months or years, like \"90d\", \"12mo\" or \"1y\"", s)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil || n == 0 {
+		return period{}, fmt.Errorf("period %q must be longer than zero", s)
+	}
+	switch match[2] {
+	case "d":
+		return period{days: n}, nil
+	case "mo":
+		return period{months: n}, nil
+	default:
+		return period{years: n}, nil
+	}
+
+}
+
+func (p period) isZero() bool {
+	return p == period{}
+}
+
+func (p period) after(t time.Time) time.Time {
+	return t.AddDate(p.years, p.months, p.days)
+}
+
+func (p period) String() string {
+
+	switch {
+	case p.years > 0:
+		return strconv.Itoa(p.years) + "y"
+	case p.months > 0:
+		return strconv.Itoa(p.months) + "mo"
+	default:
+		return strconv.Itoa(p.days) + "d"
+	}
+
+}
+
+// expiryPolicy holds the periods after which points expire. A zero period
+// means points don't expire that way.
+type expiryPolicy struct {
+	age        period
+	inactivity period
+}
+
+func (p expiryPolicy) enabled() bool {
+	return !p.age.isZero() || !p.inactivity.isZero()
+}
+
+// Adds the flags setting when points expire
+func addExpiryFlags(flags *flag.FlagSet) {
+
+	flags.StringVar(&expireAfter, "expire-after", expireAfter, "expire a receipt's points this long after its purchase, e.g. \"12mo\" (never by default)")
+	flags.StringVar(&expireInactiveAfter, "expire-inactive-after", expireInactiveAfter, "expire an account's points after this long without activity, e.g. \"6mo\" (never by default)")
+	flags.DurationVar(&expirySweepInterval, "expiry-sweep-interval", expirySweepInterval, "how often to look for expired points")
+
+}
+
+// Parses the expiry flags into the policy
+func setUpExpiry() error {
+
+	var problems []error
+	age, err := parsePeriod(expireAfter)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("expire-after: %w", err))
+	}
+	inactivity, err := parsePeriod(expireInactiveAfter)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("expire-inactive-after: %w", err))
+	}
+	if expirySweepInterval <= 0 {
+		problems = append(problems, fmt.Errorf("expiry-sweep-interval must be positive, not %s", expirySweepInterval))
+	}
+	if len(problems) > 0 {
+		return errors.Join(problems...)
+	}
+
+	expiry = expiryPolicy{age: age, inactivity: inactivity}
+	return nil
+
+}
+
+/*
+Expiration is a number of points in an account that expire, or have expired
+but not yet been swept, at the same time and for the same reason.
+*/
+type Expiration struct {
+	Points    int       `json:"points"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Reason    string    `json:"reason"`
+}
+
+/*
+Returns when the points left in a ledger expire under the policy, earliest
+first, including any that are already due. purchasedAt looks up the purchase
+date and time of a receipt; receipts it can't find are taken to have been
+purchased when their credit was posted.
+*/
+func (p expiryPolicy) expirations(entries []LedgerEntry, purchasedAt func(id string) (time.Time, bool)) []Expiration {
+
+	if !p.enabled() {
+		return []Expiration{}
+	}
+
+	var lastActivity time.Time
+	for _, entry := range entries {
+		if entry.Kind != entryCredit && entry.Kind != entryRedemption {
+			continue
+		}
+		// Credits posted before ledgers existed have no time, so the
+		// purchase stands in for it
+		activity := entry.CreatedAt
+		if activity.IsZero() && entry.ReceiptId != "" {
+			activity, _ = purchasedAt(entry.ReceiptId)
+		}
+		if activity.After(lastActivity) {
+			lastActivity = activity
+		}
+	}
+
+	var inactiveAt time.Time
+	if !p.inactivity.isZero() && !lastActivity.IsZero() {
+		inactiveAt = p.inactivity.after(lastActivity)
+	}
+
+	expirations := []Expiration{}
+	for _, lot := range remainingLots(entries, purchasedAt) {
+		if lot.points == 0 {
+			continue
+		}
+		next := Expiration{Points: lot.points, Reason: expiryReasonAge}
+		if !p.age.isZero() {
+			next.ExpiresAt = p.age.after(lot.earnedAt)
+		}
+		if !inactiveAt.IsZero() && (next.ExpiresAt.IsZero() || inactiveAt.Before(next.ExpiresAt)) {
+			next.ExpiresAt, next.Reason = inactiveAt, expiryReasonInactivity
+		}
+		if next.ExpiresAt.IsZero() {
+			continue
+		}
+
+		// Lots are in the order they were earned, which is their order of
+		// expiry by age, and inactivity expires everything left at once, so
+		// the expirations come out in order and those that can be merged are
+		// adjacent
+		if last := len(expirations) - 1; last >= 0 &&
+			expirations[last].ExpiresAt.Equal(next.ExpiresAt) && expirations[last].Reason == next.Reason {
+			expirations[last].Points += next.Points
+		} else {
+			expirations = append(expirations, next)
+		}
+	}
+
+	return expirations
+
+}
+
+// Looks up a stored receipt's purchase date and time
+func receiptPurchasedAt(id string) (time.Time, bool) {
+
+	scored, err := store.Get(id)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return scored.receipt.purchaseDatetime, true
+
+}
+
+/*
+Posts an expiry entry to every account with points past their expiry as of
+now, and returns the number of points expired. Each entry is posted against
+the version of the ledger it was worked out from, so an account that changes
+in the meantime is left for the next sweep rather than having the wrong
+points expired.
+*/
+func sweepExpiredPoints(now time.Time) (int, error) {
+
+	accountIds, err := store.ListAccounts()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	var problems []error
+	for _, accountId := range accountIds {
+		entries, err := store.GetLedger(accountId)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("account %s: %w", accountId, err))
+			continue
+		}
+
+		if len(entries) == 0 {
+			continue
+		}
+		version := entries[len(entries)-1].Sequence
+
+		due := 0
+		var reasons []string
+		for _, expiration := range expiry.expirations(entries, receiptPurchasedAt) {
+			if expiration.ExpiresAt.After(now) {
+				break
+			}
+			due += expiration.Points
+			if len(reasons) == 0 || reasons[len(reasons)-1] != expiration.Reason {
+				reasons = append(reasons, expiration.Reason)
+			}
+		}
+		if due == 0 {
+			continue
+		}
+
+		_, err = store.PostEntry(accountId, version, LedgerEntry{
+			Kind:        entryExpiry,
+			Points:      -due,
+			Description: expiry.describe(reasons),
+			CreatedAt:   now,
+		})
+		if errors.Is(err, errVersionConflict) {
+			continue
+		} else if err != nil {
+			problems = append(problems, fmt.Errorf("account %s: %w", accountId, err))
+			continue
+		}
+		expired += due
+	}
+	return expired, errors.Join(problems...)
+
+}
+
+// Describes why points expired, for the description of an expiry entry
+func (p expiryPolicy) describe(reasons []string) string {
+
+	var parts []string
+	for _, reason := range reasons {
+		switch reason {
+		case expiryReasonAge:
+			parts = append(parts, fmt.Sprintf("points more than %s old", p.age))
+		case expiryReasonInactivity:
+			parts = append(parts, fmt.Sprintf("no activity for %s", p.inactivity))
+		}
+	}
+	return "Expired: " + strings.Join(parts, "; ")
+
+}
+
+/*
+Sweeps expired points now and then every interval, until the returned
+function is called. That function waits for a sweep in progress to finish, so
+that the store can be closed safely once it returns.
+*/
+func startExpirySweeper(interval time.Duration) func() {
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			expired, err := sweepExpiredPoints(time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Sweeping expired points: %s\n", err)
+			}
+			if expired > 0 {
+				fmt.Printf("Expired %d points.\n", expired)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+
+}
+
+/*
+ExpirationsResponse is the body returned for GET requests to
+/accounts/{id}/expirations. Expirations whose time has passed are due, and
+will be taken from the balance at the next sweep.
+*/
+type ExpirationsResponse struct {
+	AccountId   string       `json:"accountId"`
+	Balance     int          `json:"balance"`
+	Expirations []Expiration `json:"expirations"`
+}
+
+// Handler for GET requests to /accounts/{id}/expirations
+func getAccountExpirations(w http.ResponseWriter, req *http.Request) {
+
+	accountId := strings.Split(req.URL.Path, "/")[2]
+
+	entries, err := store.GetLedger(accountId)
+	if !checkAccountLookup(w, err) {
+		return
+	}
+
+	resp := ExpirationsResponse{
+		AccountId:   accountId,
+		Expirations: expiry.expirations(entries, receiptPurchasedAt),
+	}
+	if len(entries) > 0 {
+		resp.Balance = entries[len(entries)-1].Balance
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Sets the expiry policy for the duration of a test
+func useExpiry(t *testing.T, policy expiryPolicy) {
+
+	old := expiry
+	t.Cleanup(func() { expiry = old })
+	expiry = policy
+
+}
+
+func date(s string) time.Time {
+
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+
+}
+
+func TestParsePeriod(t *testing.T) {
+
+	cases := map[string]period{
+		"":     {},
+		"90d":  {days: 90},
+		"12mo": {months: 12},
+		"1y":   {years: 1},
+	}
+	for s, expected := range cases {
+		if p, err := parsePeriod(s); err != nil || p != expected {
+			t.Errorf("Expected %q to parse as %+v but got %+v (error %v)", s, expected, p, err)
+		}
+	}
+
+	for _, s := range []string{"0d", "12", "1m", "-3d", "1.5y", "12 mo"} {
+		if _, err := parsePeriod(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+
+}
+
+func TestExpirations(t *testing.T) {
+
+	purchases := map[string]time.Time{
+		"r1": date("2022-01-02 13:13"),
+		"r2": date("2022-03-01 09:00"),
+	}
+	purchasedAt := func(id string) (time.Time, bool) {
+		purchased, ok := purchases[id]
+		return purchased, ok
+	}
+	ledger := func(entries ...LedgerEntry) []LedgerEntry {
+		balance := 0
+		for i := range entries {
+			balance += entries[i].Points
+			entries[i].Sequence, entries[i].Balance = i+1, balance
+		}
+		return entries
+	}
+	r1 := LedgerEntry{Kind: entryCredit, Points: 31, ReceiptId: "r1", CreatedAt: date("2022-01-03 10:00")}
+	r2 := LedgerEntry{Kind: entryCredit, Points: 20, ReceiptId: "r2", CreatedAt: date("2022-03-02 10:00")}
+
+	cases := []struct {
+		name     string
+		policy   expiryPolicy
+		entries  []LedgerEntry
+		expected []Expiration
+	}{
+		{
+			"no policy",
+			expiryPolicy{},
+			ledger(r1, r2),
+			[]Expiration{},
+		},
+		{
+			"age",
+			expiryPolicy{age: period{months: 12}},
+			ledger(r1, r2),
+			[]Expiration{
+				{31, date("2023-01-02 13:13"), expiryReasonAge},
+				{20, date("2023-03-01 09:00"), expiryReasonAge},
+			},
+		},
+		{
+			// The redemption spends the points closest to expiring
+			"redemption",
+			expiryPolicy{age: period{months: 12}},
+			ledger(r1, r2, LedgerEntry{Kind: entryRedemption, Points: -40, CreatedAt: date("2022-04-01 12:00")}),
+			[]Expiration{{11, date("2023-03-01 09:00"), expiryReasonAge}},
+		},
+		{
+			// A rescore takes points from its own receipt
+			"adjustment",
+			expiryPolicy{age: period{months: 12}},
+			ledger(r1, r2, LedgerEntry{Kind: entryAdjustment, Points: -5, ReceiptId: "r2"}),
+			[]Expiration{
+				{31, date("2023-01-02 13:13"), expiryReasonAge},
+				{15, date("2023-03-01 09:00"), expiryReasonAge},
+			},
+		},
+		{
+			"inactivity",
+			expiryPolicy{inactivity: period{months: 6}},
+			ledger(r1, r2),
+			[]Expiration{{51, date("2022-09-02 10:00"), expiryReasonInactivity}},
+		},
+		{
+			// Whichever comes first applies to each lot
+			"age and inactivity",
+			expiryPolicy{age: period{days: 200}, inactivity: period{months: 6}},
+			ledger(r1, r2),
+			[]Expiration{
+				{31, date("2022-07-21 13:13"), expiryReasonAge},
+				{20, date("2022-09-02 10:00"), expiryReasonInactivity},
+			},
+		},
+		{
+			"swept",
+			expiryPolicy{age: period{months: 12}},
+			ledger(r1, r2, LedgerEntry{Kind: entryExpiry, Points: -31, CreatedAt: date("2023-01-05 00:00")}),
+			[]Expiration{{20, date("2023-03-01 09:00"), expiryReasonAge}},
+		},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.expirations(c.entries, purchasedAt); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected %+v but got %+v", c.name, c.expected, got)
+		}
+	}
+
+}
+
+func TestSweepExpiredPoints(t *testing.T) {
+
+	useFreshStore(t)
+	useExpiry(t, expiryPolicy{age: period{months: 12}})
+
+	// 31 points purchased on 2022-01-02 and 37 on 2022-01-03
+	testPostForAccountHelper(t, accountPayload("02"), "card-1")
+	testPostForAccountHelper(t, accountPayload("03"), "card-1")
+
+	now := date("2023-01-02 20:00")
+	if expired, err := sweepExpiredPoints(now); err != nil || expired != 31 {
+		t.Fatalf("Expected 31 points to expire but got %v (error %v)", expired, err)
+	}
+	if expired, err := sweepExpiredPoints(now); err != nil || expired != 0 {
+		t.Errorf("Expected nothing more to expire but got %v (error %v)", expired, err)
+	}
+
+	entries, _ := store.GetLedger("card-1")
+	last := entries[len(entries)-1]
+	if last.Kind != entryExpiry || last.Points != -31 || last.Balance != 37 || !last.CreatedAt.Equal(now) {
+		t.Errorf("Unexpected expiry entry %+v", last)
+	}
+
+	w := testGetAccountHelper(t, getAccountExpirations, "/accounts/card-1/expirations")
+	var resp ExpirationsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON on expirations: %s", err)
+	}
+	expected := []Expiration{{37, date("2023-01-03 13:13"), expiryReasonAge}}
+	if resp.Balance != 37 || !reflect.DeepEqual(resp.Expirations, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, resp)
+	}
+
+}
+
+func TestExpirySweeper(t *testing.T) {
+
+	useFreshStore(t)
+	useExpiry(t, expiryPolicy{inactivity: period{days: 30}})
+	testPostForAccountHelper(t, accountPayload("02"), "card-1")
+
+	// The credit was posted just now, so nothing has expired yet
+	stop := startExpirySweeper(time.Hour)
+	stop()
+	if balance, _, _ := store.GetBalance("card-1"); balance != 31 {
+		t.Errorf("Expected the balance to be untouched but got %v", balance)
+	}
+
+	useExpiry(t, expiryPolicy{age: period{months: 12}})
+	stop = startExpirySweeper(time.Hour)
+	stop()
+	if balance, _, _ := store.GetBalance("card-1"); balance != 0 {
+		t.Errorf("Expected the points to have expired but the balance is %v", balance)
+	}
+
+}
+
+func TestExpirationsUnknownAccount(t *testing.T) {
+
+	useFreshStore(t)
+	w := testGetAccountHelper(t, getAccountExpirations, "/accounts/card-9/expirations")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected NotFound but got %v", w.Code)
+	}
+
+}
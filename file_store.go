@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+fileStore persists receipts to an append-only log on disk. Each change is
+written as a single line of JSON, and the whole log is replayed into a
+memoryStore when the store is opened, so reads never touch the disk.
+
+If the process dies part way through writing a line, the partial line is
+dropped the next time the log is opened.
+*/
+type fileStore struct {
+	*memoryStore
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+/*
+logEntry is a single line of the log. Op is one of:
+
+  - "save", in which case Record holds the receipt and At the time it was
+    saved, which dates the ledger entry posted for it
+  - "delete"
+  - "void", in which case Void is the record of the receipt's void. The
+    reversal of its points is posted again on replay.
+  - "post", in which case Entry is to be posted to the ledger of the account
+    with ID AccountId. The entry is written as it was posted, but posting it
+    again on replay arrives at the same sequence number and balance.
+*/
+type logEntry struct {
+	Op        string        `json:"op"`
+	Id        string        `json:"id,omitempty"`
+	Record    *storedRecord `json:"record,omitempty"`
+	At        *time.Time    `json:"at,omitempty"`
+	AccountId string        `json:"accountId,omitempty"`
+	Entry     *LedgerEntry  `json:"entry,omitempty"`
+	Void      *ReceiptVoid  `json:"void,omitempty"`
+}
+
+/*
+storedRecord, storedReceipt and storedItem mirror scoredReceipt, receipt and
+item with exported fields, so that they can be marshalled to the log. The
+receipt is kept in its validated form rather than as a RawReceipt so that
+replaying the log never depends on the validation rules of the day.
+*/
+type storedRecord struct {
+	Receipt        storedReceipt `json:"receipt"`
+	Points         int           `json:"points"`
+	Breakdown      []RuleResult  `json:"breakdown"`
+	RuleSetVersion int           `json:"ruleSetVersion"`
+	IdempotencyKey string        `json:"idempotencyKey,omitempty"`
+	ContentHash    string        `json:"contentHash,omitempty"`
+	IdStrategy     string        `json:"idStrategy,omitempty"`
+	AccountId      string        `json:"accountId,omitempty"`
+}
+
+type storedReceipt struct {
+	Retailer         string       `json:"retailer"`
+	PurchaseDatetime time.Time    `json:"purchaseDatetime"`
+	Items            []storedItem `json:"items"`
+	Cents            int          `json:"cents"`
+}
+
+type storedItem struct {
+	ShortDescription string `json:"shortDescription"`
+	Cents            int    `json:"cents"`
+}
+
+func toStoredRecord(scored scoredReceipt) *storedRecord {
+
+	r := scored.receipt
+	stored := storedReceipt{
+		Retailer:         r.retailer,
+		PurchaseDatetime: r.purchaseDatetime,
+		Items:            make([]storedItem, 0, len(r.items)),
+		Cents:            r.cents,
+	}
+	for _, item := range r.items {
+		stored.Items = append(stored.Items, storedItem{
+			ShortDescription: item.shortDescription,
+			Cents:            item.cents,
+		})
+	}
+
+	return &storedRecord{
+		Receipt:        stored,
+		Points:         scored.points,
+		Breakdown:      scored.breakdown,
+		RuleSetVersion: scored.ruleSetVersion,
+		IdempotencyKey: scored.idempotencyKey,
+		ContentHash:    scored.contentHash,
+		IdStrategy:     scored.idStrategy,
+		AccountId:      scored.accountId,
+	}
+
+}
+
+func (r *storedRecord) toScoredReceipt() scoredReceipt {
+
+	items := make([]item, 0, len(r.Receipt.Items))
+	for _, stored := range r.Receipt.Items {
+		items = append(items, item{
+			shortDescription: stored.ShortDescription,
+			cents:            stored.Cents,
+		})
+	}
+
+	scored := scoredReceipt{
+		receipt: receipt{
+			retailer:         r.Receipt.Retailer,
+			purchaseDatetime: r.Receipt.PurchaseDatetime,
+			items:            items,
+			cents:            r.Receipt.Cents,
+		},
+		points:         r.Points,
+		breakdown:      r.Breakdown,
+		ruleSetVersion: r.RuleSetVersion,
+		idempotencyKey: r.IdempotencyKey,
+		contentHash:    r.ContentHash,
+		idStrategy:     r.IdStrategy,
+		accountId:      r.AccountId,
+	}
+
+	// Entries written before content hashes were recorded get theirs now, so
+	// duplicate detection covers them too
+	if scored.contentHash == "" {
+		scored.contentHash = contentHash(scored.receipt)
+	}
+
+	// Likewise, entries written before ID strategies existed all had random IDs
+	if scored.idStrategy == "" {
+		scored.idStrategy = idStrategyRandom
+	}
+	return scored
+
+}
+
+// Opens the log at path, creating it if necessary, and replays it
+func openFileStore(path string) (*fileStore, error) {
+
+	if path == "" {
+		return nil, errors.New("the file store needs a path to its log")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening receipt log: %w", err)
+	}
+
+	s := &fileStore{memoryStore: newMemoryStore(), file: file}
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("replaying receipt log %s: %w", path, err)
+	}
+	return s, nil
+
+}
+
+// Applies every entry in the log to the in-memory copy, then positions the
+// file for appending. A trailing line without a newline is the remains of an
+// interrupted write and is truncated away.
+func (s *fileStore) replay() error {
+
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	lineNumber := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				if err := s.file.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		lineNumber++
+		offset += int64(len(line))
+
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if err := s.apply(entry); err != nil {
+			return fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+
+}
+
+// Applies a single log entry to the in-memory copy
+func (s *fileStore) apply(entry logEntry) error {
+
+	switch entry.Op {
+	case "save":
+		if entry.Record == nil {
+			return errors.New("save entry has no record")
+		}
+		// Entries written before ledgers existed have no time
+		var at time.Time
+		if entry.At != nil {
+			at = *entry.At
+		}
+		return s.memoryStore.save(entry.Id, entry.Record.toScoredReceipt(), at)
+	case "delete":
+		return s.memoryStore.Delete(entry.Id)
+	case "void":
+		if entry.Void == nil {
+			return errors.New("void entry has no void")
+		}
+		_, err := s.memoryStore.Void(entry.Id, *entry.Void)
+		return err
+	case "post":
+		if entry.Entry == nil {
+			return errors.New("post entry has no ledger entry")
+		}
+		_, err := s.memoryStore.PostEntry(entry.AccountId, anyVersion, *entry.Entry)
+		return err
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+
+}
+
+// Writes an entry to the end of the log and then applies it in memory. The
+// caller must hold the mutex, which keeps the order of the log the same as the
+// order of the changes.
+func (s *fileStore) appendLocked(entry logEntry) error {
+
+	if err := s.writeLocked(entry); err != nil {
+		return err
+	}
+	return s.apply(entry)
+
+}
+
+// Writes an entry to the end of the log without applying it. The caller must
+// hold the mutex.
+func (s *fileStore) writeLocked(entry logEntry) error {
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if s.file == nil {
+		return errors.New("receipt log is closed")
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing receipt log: %w", err)
+	}
+	return nil
+
+}
+
+func (s *fileStore) Save(id string, scored scoredReceipt) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A save the in-memory copy would refuse mustn't reach the log, or the log
+	// couldn't be replayed
+	if existing, err := s.memoryStore.Get(id); err == nil && existing.void != nil {
+		return errReceiptVoided
+	}
+	at := time.Now()
+	return s.appendLocked(logEntry{Op: "save", Id: id, Record: toStoredRecord(scored), At: &at})
+
+}
+
+func (s *fileStore) Delete(id string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.memoryStore.Get(id); err != nil {
+		return err
+	}
+	return s.appendLocked(logEntry{Op: "delete", Id: id})
+
+}
+
+func (s *fileStore) Void(id string, void ReceiptVoid) (LedgerEntry, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, err := s.memoryStore.Get(id)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	if existing.void != nil {
+		return LedgerEntry{}, errReceiptVoided
+	}
+	if err := s.writeLocked(logEntry{Op: "void", Id: id, Void: &void}); err != nil {
+		return LedgerEntry{}, err
+	}
+	return s.memoryStore.Void(id, void)
+
+}
+
+func (s *fileStore) PostEntry(accountId string, expectedVersion int, entry LedgerEntry) (LedgerEntry, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Make sure the entry can be posted before it goes in the log. Nothing
+	// else can change the ledger while the mutex is held.
+	prepared, err := s.memoryStore.prepareEntry(accountId, expectedVersion, entry)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	if err := s.appendLocked(logEntry{Op: "post", AccountId: accountId, Entry: &prepared}); err != nil {
+		return LedgerEntry{}, err
+	}
+	return prepared, nil
+
+}
+
+// Flushes the log to disk and closes it
+func (s *fileStore) Close() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := errors.Join(s.file.Sync(), s.file.Close())
+	s.file = nil
+	return err
+
+}
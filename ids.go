@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+/*
+The strategies processReceipt can use to assign receipt IDs, chosen with the
+-id-strategy flag:
+
+  - random: a random UUIDv4, as the example IDs in the spec imply
+  - time: a UUIDv7, which begins with a timestamp so that IDs sort in the
+    order the receipts were submitted
+  - content: a UUIDv5 derived from the receipt's canonical form, so that
+    anyone holding the receipt can work out its ID without a lookup
+*/
+const (
+	idStrategyRandom  = "random"
+	idStrategyTime    = "time"
+	idStrategyContent = "content"
+)
+
+// The strategy used for newly submitted receipts
+var idStrategy = idStrategyRandom
+
+// Namespace for content-derived IDs. Itself derived from the URL of the spec,
+// so that other implementations can reproduce it.
+var receiptNamespace = uuid.NewSHA1(uuid.NameSpaceURL,
+	[]byte("https://github.com/fetch-rewards/receipt-processor-challenge"))
+
+// Checks that a strategy named on the command line is one we know
+func validateIdStrategy(strategy string) error {
+
+	switch strategy {
+	case idStrategyRandom, idStrategyTime, idStrategyContent:
+		return nil
+	default:
+		return fmt.Errorf("unknown ID strategy %q, expected %q, %q or %q",
+			strategy, idStrategyRandom, idStrategyTime, idStrategyContent)
+	}
+
+}
+
+// Generates an ID for the receipt using the given strategy
+func newReceiptId(strategy string, r receipt) (string, error) {
+
+	var id uuid.UUID
+	var err error
+	switch strategy {
+	case idStrategyRandom:
+		id, err = uuid.NewRandom()
+	case idStrategyTime:
+		id, err = uuid.NewV7()
+	case idStrategyContent:
+		id = uuid.NewSHA1(receiptNamespace, canonicalReceipt(r))
+	default:
+		err = validateIdStrategy(strategy)
+	}
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+
+}
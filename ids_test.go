@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Switches the ID strategy for the duration of a test
+func useIdStrategy(t *testing.T, strategy string) {
+
+	old := idStrategy
+	t.Cleanup(func() { idStrategy = old })
+	idStrategy = strategy
+
+}
+
+func TestIdStrategies(t *testing.T) {
+
+	versions := map[string]uuid.Version{
+		idStrategyRandom:  4,
+		idStrategyTime:    7,
+		idStrategyContent: 5,
+	}
+
+	for strategy, version := range versions {
+		useFreshStore(t)
+		useIdStrategy(t, strategy)
+
+		id := testPostHelper(t, dedupePayload)
+		parsed, err := uuid.Parse(id)
+		if err != nil || parsed.Version() != version {
+			t.Errorf("Strategy %s: expected a version %d UUID but got %q", strategy, version, id)
+		}
+		if br := testGetBreakdownHelper(t, id); br.IdStrategy != strategy {
+			t.Errorf("Strategy %s: recorded as %q", strategy, br.IdStrategy)
+		}
+	}
+
+}
+
+func TestContentIdsAreDeterministic(t *testing.T) {
+
+	useFreshStore(t)
+	useIdStrategy(t, idStrategyContent)
+
+	validReceipt, _ := validateAndConvertReceipt(RawReceipt{
+		Retailer:     "Walgreens",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "08:13",
+		Total:        "2.65",
+		Items: []RawItem{
+			{ShortDescription: "Pepsi - 12-oz", Price: "1.25"},
+			{ShortDescription: "Dasani", Price: "1.40"},
+		},
+	})
+	expected, _ := newReceiptId(idStrategyContent, validReceipt)
+
+	// Submitting the same receipt twice yields the same, derivable ID and
+	// stores it only once
+	first := testPostHelper(t, dedupePayload)
+	second := testPostHelper(t, dedupePayload)
+	if first != expected || second != expected {
+		t.Errorf("Expected %v twice but got %v and %v", expected, first, second)
+	}
+	if ids, _ := store.List(); len(ids) != 1 {
+		t.Errorf("Expected 1 stored receipt but got %v", len(ids))
+	}
+
+}
+
+func TestUnknownIdStrategy(t *testing.T) {
+	if err := validateIdStrategy("sequential"); err == nil {
+		t.Errorf("An unknown ID strategy should be rejected")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+/*
+Every account has a ledger: an append-only history of the entries that changed
+its balance. Entries are never edited or removed, and each records the balance
+after it, so the entries always sum to the account's balance.
+
+The kinds of entry are:
+
+  - credit: the points earned by a receipt submitted for the account
+  - adjustment: the change in a receipt's points when it is rescored
+  - redemption: points spent through /accounts/{id}/redemptions
+  - expiry: points taken away by the expiry sweeper (see expiry.go)
+  - reversal: the points of a receipt that has been voided (see voids.go)
+
+The balance can never go below zero. A redemption larger than the balance is
+refused, and an adjustment that takes away more points than the account has
+left, like an expiry or a reversal, only takes away what is there.
+
+Points are spent oldest first. Each credit, and each increase in a receipt's
+points when it is rescored, is a lot of points earned at the receipt's
+purchase, and debits use up lots in the order they were earned. A debit for a
+particular receipt, such as a rescore that lowers its points, uses up that
+receipt's lots first, and can take no more than they have left: points that
+have already been redeemed or have expired can't be taken back.
+*/
+const (
+	entryCredit     = "credit"
+	entryAdjustment = "adjustment"
+	entryRedemption = "redemption"
+	entryExpiry     = "expiry"
+)
+
+/*
+LedgerEntry is a single entry in an account's ledger. Sequence numbers start
+at 1 and count up without gaps, and the sequence number of an account's latest
+entry is the account's version, used to detect concurrent redemptions.
+*/
+type LedgerEntry struct {
+	Sequence    int       `json:"sequence"`
+	Kind        string    `json:"kind"`
+	Points      int       `json:"points"`
+	Balance     int       `json:"balance"`
+	ReceiptId   string    `json:"receiptId,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Passed as the expected version when posting an entry that doesn't depend on
+// what the client last saw of the account, e.g. a receipt's credit
+const anyVersion = -1
+
+var errVersionConflict = errors.New("the account has changed since the expected version")
+var errInsufficientPoints = errors.New("the account doesn't have enough points")
+
+/*
+Works out the entry that posting to a ledger holding the given entries would
+append: its sequence number, the balance after it, and for debits other than
+redemptions, how many points can actually be taken. Fails if the ledger isn't
+at the expected version, or if a redemption would overdraw the account.
+*/
+func nextLedgerEntry(entries []LedgerEntry, expectedVersion int, entry LedgerEntry) (LedgerEntry, error) {
+
+	version, balance := 0, 0
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		version, balance = last.Sequence, last.Balance
+	}
+
+	if expectedVersion != anyVersion && expectedVersion != version {
+		return LedgerEntry{}, errVersionConflict
+	}
+	if balance+entry.Points < 0 {
+		if entry.Kind == entryRedemption {
+			return LedgerEntry{}, errInsufficientPoints
+		}
+		entry.Points = -balance
+	}
+
+	entry.Sequence = version + 1
+	entry.Balance = balance + entry.Points
+	return entry, nil
+
+}
+
+// A number of points earned together, and when they were earned
+type pointLot struct {
+	receiptId string
+	points    int
+	earnedAt  time.Time
+}
+
+// Takes up to points from the lot, and returns how many are left to take
+func (l *pointLot) take(points int) int {
+
+	taken := min(l.points, points)
+	l.points -= taken
+	return points - taken
+
+}
+
+/*
+Returns the lots of points left in a ledger, oldest first. purchasedAt looks
+up the purchase date and time of a receipt; points for receipts it can't find
+are taken to have been earned when they were posted.
+*/
+func remainingLots(entries []LedgerEntry, purchasedAt func(id string) (time.Time, bool)) []pointLot {
+
+	var lots []pointLot
+	for _, entry := range entries {
+		if entry.Points > 0 {
+			lot := pointLot{receiptId: entry.ReceiptId, points: entry.Points, earnedAt: entry.CreatedAt}
+			if entry.ReceiptId != "" {
+				if purchased, ok := purchasedAt(entry.ReceiptId); ok {
+					lot.earnedAt = purchased
+				}
+			}
+			i := sort.Search(len(lots), func(i int) bool { return lot.earnedAt.Before(lots[i].earnedAt) })
+			lots = append(lots[:i], append([]pointLot{lot}, lots[i:]...)...)
+			continue
+		}
+
+		remaining := -entry.Points
+		if entry.ReceiptId != "" {
+			for i := range lots {
+				if lots[i].receiptId == entry.ReceiptId {
+					remaining = lots[i].take(remaining)
+				}
+			}
+		}
+		for i := range lots {
+			remaining = lots[i].take(remaining)
+		}
+	}
+	return lots
+
+}
+
+// Returns how many of a receipt's points are left in the lots
+func receiptPointsLeft(lots []pointLot, receiptId string) int {
+
+	points := 0
+	for _, lot := range lots {
+		if lot.receiptId == receiptId {
+			points += lot.points
+		}
+	}
+	return points
+
+}
+
+/*
+Returns the points a ledger has credited for a receipt, net of its
+adjustments and reversal, and whether it holds any entry for the receipt at
+all. This can be less than the receipt's points, if a rescore lowered them
+after some had been spent.
+*/
+func receiptCredited(entries []LedgerEntry, receiptId string) (int, bool) {
+
+	points, found := 0, false
+	for _, entry := range entries {
+		if entry.ReceiptId == receiptId {
+			points += entry.Points
+			found = true
+		}
+	}
+	return points, found
+
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// The largest body, in bytes, accepted for a single receipt or rule config.
+// Set with -max-body-bytes; a larger body gets a 413.
+var maxBodyBytes int64 = 1 << 20
+
+// The largest body, in bytes, accepted by /receipts/batch. Set with
+// -max-batch-bytes.
+var maxBatchBytes int64 = 64 << 20
+
+// The most items a single receipt may list. Set with -max-items.
+var maxItems = 1000
+
+// Adds the flags setting the limits on what clients may send
+func addLimitFlags(flags *flag.FlagSet) {
+
+	flags.Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "largest request body accepted for a single receipt, in bytes")
+	flags.Int64Var(&maxBatchBytes, "max-batch-bytes", maxBatchBytes, "largest request body accepted by /receipts/batch, in bytes")
+	flags.IntVar(&maxItems, "max-items", maxItems, "most items a receipt may list")
+
+}
+
+// Checks that each limit leaves room for at least one receipt
+func validateLimits() error {
+
+	var problems []error
+	if maxBodyBytes <= 0 {
+		problems = append(problems, fmt.Errorf("max-body-bytes must be positive, not %d", maxBodyBytes))
+	}
+	if maxBatchBytes <= 0 {
+		problems = append(problems, fmt.Errorf("max-batch-bytes must be positive, not %d", maxBatchBytes))
+	}
+	if maxItems <= 0 {
+		problems = append(problems, fmt.Errorf("max-items must be positive, not %d", maxItems))
+	}
+	return errors.Join(problems...)
+
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sets a limit for the duration of a test
+func useLimit[T int | int64](t *testing.T, limit *T, value T) {
+
+	old := *limit
+	t.Cleanup(func() { *limit = old })
+	*limit = value
+
+}
+
+func TestBodyTooLarge(t *testing.T) {
+
+	useFreshStore(t)
+	useLimit(t, &maxBodyBytes, 64)
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(batchReceiptA))
+	w := httptest.NewRecorder()
+	processReceipt(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %v but got %v: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body)
+	}
+	if ids, _ := store.List(); len(ids) != 0 {
+		t.Errorf("Oversized receipt was stored")
+	}
+
+}
+
+func TestTooManyItems(t *testing.T) {
+
+	useLimit(t, &maxItems, 1)
+
+	payload := `{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "2.50",
+		"items": [{"shortDescription": "Pepsi", "price": "1.25"}, {"shortDescription": "Pepsi", "price": "1.25<"}]}`
+	problems := testBadPostHelper(t, []byte(payload))
+
+	// The items aren't validated individually once there are too many
+	expectProblems(t, problems, ValidationError{Path: "/items", Code: "too_many_items"})
+
+}
+
+func TestTruncatedBody(t *testing.T) {
+
+	problems := testBadPostHelper(t, []byte(batchReceiptA[:40]))
+	expectProblems(t, problems, ValidationError{Path: "", Code: "truncated_json"})
+
+}
+
+func TestEmptyBody(t *testing.T) {
+
+	problems := testBadPostHelper(t, []byte("  "))
+	expectProblems(t, problems, ValidationError{Path: "", Code: "malformed_json"})
+
+}
+
+func TestTrailingData(t *testing.T) {
+
+	problems := testBadPostHelper(t, []byte(batchReceiptA+" {}"))
+	expectProblems(t, problems, ValidationError{Path: "", Code: "malformed_json"})
+
+}
+
+// A request body that fails partway through
+type failingReader struct{ data io.Reader }
+
+func (r failingReader) Read(p []byte) (int, error) {
+
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+
+}
+
+func TestUnreadableBody(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", failingReader{strings.NewReader(`{"retailer": `)})
+	w := httptest.NewRecorder()
+	processReceipt(w, req)
+
+	if w.Code != http.StatusBadRequest || w.Body.String() != "The request body could not be read." {
+		t.Errorf("Expected the body to be reported unreadable but got %v: %s", w.Code, w.Body)
+	}
+
+}
+
+func TestBatchTooLarge(t *testing.T) {
+
+	useFreshStore(t)
+	useLimit(t, &maxBatchBytes, int64(len(batchReceiptA)+10))
+
+	br := testBatchHelper(t, batchReceiptA+"\n"+batchReceiptB+"\n")
+	if br.Accepted != 1 || len(br.Results) != 2 || br.Results[1].Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the first receipt stored and the rest refused but got %+v", br)
+	}
+
+	br = testBatchHelper(t, "["+batchReceiptA+", "+batchReceiptB+"]")
+	if br.Accepted != 1 || len(br.Results) != 2 || br.Results[1].Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the first receipt stored and the rest refused but got %+v", br)
+	}
+
+}
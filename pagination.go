@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of receipts in a page when the client doesn't ask for a number,
+// and the most they may ask for
+const defaultPageSize = 20
+const maxPageSize = 100
+
+/*
+ReceiptSummary describes one receipt in a page of receipts. The purchase date,
+time and total are written as they are in the API.
+*/
+type ReceiptSummary struct {
+	Id           string `json:"id"`
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Total        string `json:"total"`
+	Points       int    `json:"points"`
+	Voided       bool   `json:"voided,omitempty"`
+}
+
+/*
+ReceiptPage is one page of a list of receipts, which are always ordered with
+the most recent purchase first (and by ID among receipts purchased at the same
+time). NextCursor is only present if there are more receipts, and is passed
+back as the cursor query parameter to fetch them.
+*/
+type ReceiptPage struct {
+	Receipts   []ReceiptSummary `json:"receipts"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+/*
+receiptCursor marks a position in the order receipts are listed in. It holds
+the sort key of the last receipt on a page rather than an offset, so that
+receipts saved or deleted between requests don't make later pages skip or
+repeat any.
+*/
+type receiptCursor struct {
+	purchaseDatetime time.Time
+	id               string
+}
+
+// Reports whether the receipt with the given sort key is listed after the
+// cursor's position
+func (c receiptCursor) precedes(purchaseDatetime time.Time, id string) bool {
+
+	if !purchaseDatetime.Equal(c.purchaseDatetime) {
+		return purchaseDatetime.Before(c.purchaseDatetime)
+	}
+	return id > c.id
+
+}
+
+// Encodes the cursor as an opaque string for the client
+func (c receiptCursor) String() string {
+
+	key := fmt.Sprintf("%d|%s", c.purchaseDatetime.Unix(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+
+}
+
+// Decodes a cursor given by the client
+func parseCursor(s string) (receiptCursor, error) {
+
+	invalid := errors.New("the cursor is not one this server gave out")
+
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return receiptCursor{}, invalid
+	}
+	seconds, id, found := strings.Cut(string(key), "|")
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if !found || err != nil {
+		return receiptCursor{}, invalid
+	}
+	return receiptCursor{purchaseDatetime: time.Unix(unix, 0).UTC(), id: id}, nil
+
+}
+
+// The page a client asked for with the limit and cursor query parameters.
+// after is nil for the first page.
+type pageRequest struct {
+	limit int
+	after *receiptCursor
+}
+
+// Reads the limit and cursor query parameters from a request
+func readPageRequest(req *http.Request) (pageRequest, error) {
+
+	query := req.URL.Query()
+	page := pageRequest{limit: defaultPageSize}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return pageRequest{}, fmt.Errorf("limit must be a whole number from 1 to %d", maxPageSize)
+		}
+		page.limit = n
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := parseCursor(cursor)
+		if err != nil {
+			return pageRequest{}, err
+		}
+		page.after = &after
+	}
+	return page, nil
+
+}
+
+// Fetches the receipts with the given IDs for which keep returns true, and
+// returns the requested page of them. Receipts deleted since the IDs were
+// listed are skipped.
+func buildReceiptPage(ids []string, page pageRequest, keep func(scoredReceipt) bool) (ReceiptPage, error) {
+
+	type listed struct {
+		id     string
+		scored scoredReceipt
+	}
+	var receipts []listed
+	for _, id := range ids {
+		scored, err := store.Get(id)
+		if errors.Is(err, errReceiptNotFound) {
+			continue
+		} else if err != nil {
+			return ReceiptPage{}, err
+		}
+		if page.after != nil && !page.after.precedes(scored.receipt.purchaseDatetime, id) {
+			continue
+		}
+		if keep != nil && !keep(scored) {
+			continue
+		}
+		receipts = append(receipts, listed{id, scored})
+	}
+
+	sort.Slice(receipts, func(i, j int) bool {
+		a, b := receipts[i], receipts[j]
+		return receiptCursor{a.scored.receipt.purchaseDatetime, a.id}.precedes(b.scored.receipt.purchaseDatetime, b.id)
+	})
+
+	result := ReceiptPage{Receipts: []ReceiptSummary{}}
+	for i, r := range receipts {
+		if i == page.limit {
+			last := receipts[i-1]
+			result.NextCursor = receiptCursor{last.scored.receipt.purchaseDatetime, last.id}.String()
+			break
+		}
+		raw := r.scored.receipt.toRaw()
+		result.Receipts = append(result.Receipts, ReceiptSummary{
+			Id:           r.id,
+			Retailer:     raw.Retailer,
+			PurchaseDate: raw.PurchaseDate,
+			PurchaseTime: raw.PurchaseTime,
+			Total:        raw.Total,
+			Points:       r.scored.points,
+			Voided:       r.scored.void != nil,
+		})
+	}
+	return result, nil
+
+}
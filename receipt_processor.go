@@ -8,18 +8,18 @@ https://github.com/fetch-rewards/receipt-processor-challenge
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"math"
+	"log"
 	"net/http"
+	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
-	"unicode"
-
-	"github.com/google/uuid"
 )
 
 /*
@@ -57,214 +57,684 @@ type receipt struct {
 	cents            int
 }
 
-// Maps receipt UUIDs to the points that they earned on submission
-var receiptPoints map[string]int = make(map[string]int)
+// Converts a receipt back into the shape used by the API, e.g. for returning
+// a stored receipt to the client
+func (r receipt) toRaw() RawReceipt {
 
-// Implements this rule from the spec:
-//
-// One point for every alphanumeric character in the retailer name.
-func scoreRetailerName(r receipt, oldScore *int) {
-	for _, char := range r.retailer {
-		if unicode.IsLetter(char) || unicode.IsNumber(char) {
-			*oldScore += 1
-		}
+	raw := RawReceipt{
+		Retailer:     r.retailer,
+		PurchaseDate: r.purchaseDatetime.Format("2006-01-02"),
+		PurchaseTime: r.purchaseDatetime.Format("15:04"),
+		Items:        make([]RawItem, 0, len(r.items)),
+		Total:        formatCents(r.cents),
 	}
+	for _, item := range r.items {
+		raw.Items = append(raw.Items, RawItem{
+			ShortDescription: item.shortDescription,
+			Price:            formatCents(item.cents),
+		})
+	}
+	return raw
+
 }
 
-// Implements this rule from the spec:
-//
-// 50 points if the total is a round dollar amount with no cents.
-func scoreNoCentsBonus(r receipt, oldScore *int) {
-	if r.cents%100 == 0 {
-		*oldScore += 50
-	}
+/*
+scoredReceipt holds what is recorded about a receipt when it is scored: the
+validated receipt itself, the points it earned, the contribution of each rule
+to that total, and the version of the rule set that did the scoring. The
+idempotency key (if the client sent one) and content hash are kept so that
+resubmissions of the same receipt can be recognised, and the strategy used to
+generate the receipt's ID is kept alongside it. accountId is empty unless the
+receipt was submitted on behalf of an account.
+*/
+type scoredReceipt struct {
+	receipt        receipt
+	points         int
+	breakdown      []RuleResult
+	ruleSetVersion int
+	idempotencyKey string
+	contentHash    string
+	idStrategy     string
+	accountId      string
+	void           *ReceiptVoid
 }
 
-// Implements this rule from the spec:
-//
-// 25 points if the total is a multiple of 0.25.
-func scoreEvenQuarterBonus(r receipt, oldScore *int) {
-	if r.cents%25 == 0 {
-		*oldScore += 25
+// Handler for POST requests to /receipts/process
+func processReceipt(w http.ResponseWriter, req *http.Request) {
+
+	accountId, ok := requestAccount(w, req)
+	if !ok {
+		return
 	}
+	validReceipt, ok := readReceipt(w, req)
+	if !ok {
+		return
+	}
+
+	sub := submitReceipt(validReceipt, req.Header.Get("Idempotency-Key"), accountId)
+	writeSubmission(w, sub)
+
 }
 
-// Implements this rule from the spec:
-//
-// 5 points for every two items on the receipt.
-func scoreNumItems(r receipt, oldScore *int) {
-	*oldScore += (len(r.items) / 2) * 5
+/*
+submission is the outcome of submitting a single receipt. On success status is
+200 and id holds the receipt's ID. A duplicate gets a 409 along with the ID of
+the original, an invalid receipt gets a 400 along with the problems found, and
+any other failure carries a message for the client.
+*/
+type submission struct {
+	status   int
+	id       string
+	message  string
+	problems []ValidationError
 }
 
-// Implements this rule from the spec:
-//
-// If the trimmed length of the item description is a multiple of 3, multiply
-// the price by 0.2 and round up to the nearest integer. The result is the
-// number of points earned.
-func scoreItemDescriptionLengths(r receipt, oldScore *int) {
-	for _, item := range r.items {
-		if len(strings.TrimSpace(item.shortDescription))%3 == 0 {
-			*oldScore += int(math.Ceil(float64(item.cents) * 0.002))
+// Sends the client the outcome of their submission
+func writeSubmission(w http.ResponseWriter, sub submission) {
+
+	switch sub.status {
+	case http.StatusOK:
+		// Return the UUID as a JSON object
+		fmt.Fprintf(w, "{ \"id\": \"%v\" }", sub.id)
+	case http.StatusBadRequest:
+		writeValidationErrors(w, sub.problems)
+	case http.StatusConflict:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(DuplicateResponse{Id: sub.id, Message: sub.message})
+	default:
+		w.WriteHeader(sub.status)
+		fmt.Fprintf(w, "%s", sub.message)
+	}
+
+}
+
+// Scores a validated receipt and saves it in the store under a new ID. The
+// key is the client's Idempotency-Key, if they sent one, and the points are
+// credited to the account with the given ID, if it isn't empty.
+func submitReceipt(validReceipt receipt, key string, accountId string) submission {
+
+	// If this is a retry of a request that was already handled, or (when
+	// duplicate detection is on) a copy of a receipt already stored, answer
+	// with the original ID rather than awarding the points twice
+	strategy := idStrategy
+	hash := contentHash(validReceipt)
+	hashToLock := ""
+	if detectDuplicates || strategy == idStrategyContent {
+		hashToLock = hash
+	}
+	unlock := lockSubmission(key, hashToLock)
+	defer unlock()
+	if sub, found := findResubmission(key, hash, accountId); found {
+		return sub
+	}
+
+	// Generate the ID that will correspond to this receipt's recorded points
+	newId, err := newReceiptId(strategy, validReceipt)
+	if err != nil {
+		return submission{status: http.StatusInternalServerError, message: "The receipt could not be assigned an ID."}
+	}
+
+	// Content-derived IDs are the same for every copy of a receipt, so a copy
+	// that gets this far is answered with the ID of the one already stored,
+	// unless that one can't stand in for it: a copy for another account would
+	// never be credited, and a voided receipt earns nothing
+	if strategy == idStrategyContent {
+		if prior, err := store.Get(newId); err == nil {
+			switch {
+			case prior.accountId != accountId:
+				return submission{status: http.StatusConflict, id: newId,
+					message: "This receipt has already been submitted for a different account."}
+			case prior.void != nil:
+				return submission{status: http.StatusConflict, id: newId,
+					message: "This receipt has already been submitted, and has since been voided."}
+			}
+			return submission{status: http.StatusOK, id: newId}
 		}
 	}
+
+	// Run the receipt through each of the active rules and tally up the total
+	// score, keeping track of what each rule contributed
+	rules := activeRules.Load()
+	pointsEarned, breakdown := rules.registry.Breakdown(validReceipt)
+
+	// Save the points under the receipt UUID in the store
+	err = store.Save(newId, scoredReceipt{
+		receipt:        validReceipt,
+		points:         pointsEarned,
+		breakdown:      breakdown,
+		ruleSetVersion: rules.version,
+		idempotencyKey: key,
+		contentHash:    hash,
+		idStrategy:     strategy,
+		accountId:      accountId,
+	})
+	if err != nil {
+		return submission{status: http.StatusInternalServerError, message: "The receipt could not be saved."}
+	}
+
+	return submission{status: http.StatusOK, id: newId}
+
 }
 
-// Implements this rule from the spec:
-//
-// 6 points if the day in the purchase date is odd.
-func scoreOddPurchaseDates(r receipt, oldScore *int) {
-	if r.purchaseDatetime.Day()%2 == 1 {
-		*oldScore += 6
+/*
+ScoreResponse is the body returned for POST requests to /receipts/score. Points
+is always the sum of the breakdown's points. TotalDiscrepancy is only present
+if the receipt's total doesn't match its items.
+*/
+type ScoreResponse struct {
+	Points           int               `json:"points"`
+	RuleSetVersion   int               `json:"ruleSetVersion"`
+	Breakdown        []RuleResult      `json:"breakdown"`
+	TotalDiscrepancy *TotalDiscrepancy `json:"totalDiscrepancy,omitempty"`
+}
+
+// Handler for POST requests to /receipts/score. Scores the receipt exactly as
+// /receipts/process would, but neither assigns it an ID nor stores it, so
+// clients can preview the points a receipt would earn.
+func scoreReceipt(w http.ResponseWriter, req *http.Request) {
+
+	validReceipt, ok := readReceipt(w, req)
+	if !ok {
+		return
 	}
+
+	rules := activeRules.Load()
+	pointsEarned, breakdown := rules.registry.Breakdown(validReceipt)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ScoreResponse{
+		Points:           pointsEarned,
+		RuleSetVersion:   rules.version,
+		Breakdown:        breakdown,
+		TotalDiscrepancy: totalDiscrepancy(validReceipt),
+	})
+
 }
 
-// Implements this rule from the spec:
-//
-// 10 points if the time of purchase is after 2:00pm and before 4:00pm.
-func scoreAfternoonBonus(r receipt, oldScore *int) {
-	const (
-		twoPm  = 14 * 60
-		fourPm = 16 * 60
-	)
-	purchaseTime := r.purchaseDatetime.Hour()*60 + r.purchaseDatetime.Minute()
-	if twoPm < purchaseTime && purchaseTime < fourPm {
-		*oldScore += 10
+// Reads a receipt from the body of a request and validates it, strictly if
+// the request or the server's configuration asks for it. If anything is wrong
+// with it, the client is sent a 400 (or a 413 if the body is larger than
+// maxBodyBytes) and the returned bool is false.
+func readReceipt(w http.ResponseWriter, req *http.Request) (receipt, bool) {
+
+	strict, ok := requestStrictness(w, req)
+	if !ok {
+		return receipt{}, false
+	}
+
+	body := http.MaxBytesReader(w, req.Body, maxBodyBytes)
+	validReceipt, problems, err := decodeReceipt(body, strict)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "The request body is larger than the limit of %d bytes.", tooLarge.Limit)
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The request body could not be read.")
+	case len(problems) > 0:
+		// If the receipt can't be parsed or fails validation, send the client
+		// a 400 listing everything that's wrong with it
+		writeValidationErrors(w, problems)
+	default:
+		return validReceipt, true
 	}
+	return receipt{}, false
+
 }
 
-// Handler for POST requests to /receipts/process
-func processReceipt(w http.ResponseWriter, req *http.Request) {
+// Unmarshals a single receipt from JSON and validates it, strictly if asked
+// to (see strict.go). Every problem found is returned, so an empty slice
+// indicates success.
+func parseReceipt(data []byte, strict bool) (receipt, []ValidationError) {
+
+	// Reading from memory can't fail, so any error is a problem with the JSON
+	validReceipt, problems, _ := decodeReceipt(bytes.NewReader(data), strict)
+	return validReceipt, problems
+
+}
+
+/*
+Decodes a single receipt from reader and validates it, strictly if asked to.
+Every problem found with the receipt is returned, so an empty slice indicates
+success.
+
+The error is only set if reader itself fails, e.g. because the body was cut
+off by http.MaxBytesReader, in which case nothing is known about the receipt.
+A body that simply ends partway through the JSON is a problem with the
+receipt, not an error.
+*/
+func decodeReceipt(reader io.Reader, strict bool) (receipt, []ValidationError, error) {
+
+	// Read the JSON value, without interpreting it yet
+	decoder := json.NewDecoder(reader)
+	var data json.RawMessage
+	if err := decoder.Decode(&data); err != nil {
+		if isReadError(err) {
+			return receipt{}, nil, err
+		}
+		return receipt{}, []ValidationError{describeJSONError(err)}, nil
+	}
+
+	// Make sure nothing follows it
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		if isReadError(err) {
+			return receipt{}, nil, err
+		}
+		return receipt{}, []ValidationError{{
+			Path:    "",
+			Code:    "malformed_json",
+			Message: "the body continues after the receipt's JSON object",
+		}}, nil
+	}
 
-	// Generate UUID that will correspond to this receipt's recorded points
-	newId, _ := uuid.NewRandom()
+	var strictFound []ValidationError
+	if strict {
+		strictFound = strictProblems(data)
+	}
 
 	// Unpack the receipt JSON into rawReceipt
 	var rawReceipt RawReceipt
-	data, _ := io.ReadAll(req.Body)
-	err := json.Unmarshal(data, &rawReceipt)
-	// If parsing the JSON fails, send the client a 400
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "The receipt is invalid.")
-		return
+	if err := json.Unmarshal(data, &rawReceipt); err != nil {
+		return receipt{}, mergeStrictProblems(strictFound, []ValidationError{describeJSONError(err)}), nil
 	}
 
-	// Convert rawReceipt into validReceipt, and in so doing ensure that the
-	// JSON meets additional API requirements. If it doesn't, send the client
-	// a 400.
-	validReceipt, validationSuccessful := validateAndConvertReceipt(rawReceipt)
-	if !validationSuccessful {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "The receipt is invalid.")
-		return
+	// Convert rawReceipt into a receipt, and in so doing ensure that the JSON
+	// meets additional API requirements
+	validReceipt, problems := validateAndConvertReceipt(rawReceipt)
+	if len(strictFound) > 0 {
+		return receipt{}, mergeStrictProblems(strictFound, problems), nil
+	}
+	return validReceipt, problems, nil
+
+}
+
+// Reports whether an error from a json.Decoder came from the reader beneath
+// it, rather than from the JSON being read
+func isReadError(err error) bool {
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// The body ended, either before anything or partway through a value
+		return false
+	default:
+		return true
 	}
 
-	// Call each of the score functions and tally up the total score
-	pointsEarned := 0
-	scoreRetailerName(validReceipt, &pointsEarned)
-	scoreNoCentsBonus(validReceipt, &pointsEarned)
-	scoreEvenQuarterBonus(validReceipt, &pointsEarned)
-	scoreNumItems(validReceipt, &pointsEarned)
-	scoreItemDescriptionLengths(validReceipt, &pointsEarned)
-	scoreOddPurchaseDates(validReceipt, &pointsEarned)
-	scoreAfternoonBonus(validReceipt, &pointsEarned)
+}
+
+/*
+ValidationError describes a single problem with a submitted receipt. Path is a
+JSON pointer to the offending field, e.g. /items/2/price, and is empty when
+the problem is with the body as a whole. Code is a stable, machine-readable
+name for the kind of problem, and Message is meant for humans.
+*/
+type ValidationError struct {
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the JSON body sent along with a 400 for an invalid receipt
+type ErrorResponse struct {
+	Message string            `json:"message"`
+	Errors  []ValidationError `json:"errors"`
+}
+
+// Sends the client a 400 listing every problem found with their receipt
+func writeValidationErrors(w http.ResponseWriter, problems []ValidationError) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Message: "The receipt is invalid.",
+		Errors:  problems,
+	})
+
+}
+
+// Describes why the body of a request couldn't be unmarshalled into a
+// RawReceipt, pointing at the offending field where the JSON is well-formed
+// but a value has the wrong type, or at the whole body if it isn't an object
+func describeJSONError(err error) ValidationError {
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		path := ""
+		if typeErr.Field != "" {
+			path = "/" + strings.ReplaceAll(typeErr.Field, ".", "/")
+		}
+		return ValidationError{
+			Path:    path,
+			Code:    "invalid_type",
+			Message: fmt.Sprintf("expected JSON %s but got JSON %s", jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value),
+		}
+	case errors.Is(err, io.EOF):
+		return ValidationError{
+			Path:    "",
+			Code:    "malformed_json",
+			Message: "the body is empty",
+		}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ValidationError{
+			Path:    "",
+			Code:    "truncated_json",
+			Message: "the body ends before the JSON is complete",
+		}
+	}
+	return ValidationError{
+		Path:    "",
+		Code:    "malformed_json",
+		Message: fmt.Sprintf("the body is not valid JSON: %s", err),
+	}
 
-	// Save the receipt UUID and points as a key-value pair in pointsEarned
-	receiptPoints[newId.String()] = pointsEarned
+}
 
-	// Return the UUID as a JSON object
-	fmt.Fprintf(w, "{ \"id\": \"%v\" }", newId)
+// Translates the name of a Go kind into the name of the matching JSON type
+func jsonTypeName(kind string) string {
+
+	switch kind {
+	case "string":
+		return "string"
+	case "slice", "array":
+		return "array"
+	case "struct", "map":
+		return "object"
+	default:
+		return kind
+	}
 
 }
 
 // Attempts to convert a RawReceipt into a receipt, validating API requirements
-// along the way. Returned bool indicates success/failure.
-func validateAndConvertReceipt(old RawReceipt) (receipt, bool) {
+// along the way. Every problem found is returned, so an empty slice indicates
+// success.
+func validateAndConvertReceipt(old RawReceipt) (receipt, []ValidationError) {
 
-	// Prepare the regexes used to validate names, descriptions, and prices
+	// Prepare the regex used to validate names and descriptions
 	retailerAndDescRegex := regexp.MustCompile(`^[\w\s\-&]+$`)
-	priceRegex := regexp.MustCompile(`^\d+\.\d{2}$`)
 
 	var new receipt = receipt{}
+	var problems []ValidationError
+	problem := func(path string, code string, format string, args ...any) {
+		problems = append(problems, ValidationError{
+			Path:    path,
+			Code:    code,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
 
 	// Validate and copy over retailer name
-	match := retailerAndDescRegex.MatchString(old.Retailer)
-	if !match {
-		return receipt{}, false
+	if old.Retailer == "" {
+		problem("/retailer", "required", "retailer is required")
+	} else if !retailerAndDescRegex.MatchString(old.Retailer) {
+		problem("/retailer", "invalid_characters",
+			"retailer may only contain letters, digits, spaces, '-' and '&'")
 	}
 	new.retailer = old.Retailer
 
 	// Validate and copy over purchase date and time
-	dateString := old.PurchaseDate + " " + old.PurchaseTime
-	datetime, err := time.Parse("2006-01-02 15:04", dateString)
-	if err != nil {
-		fmt.Println(err)
-		return receipt{}, false
+	date, dateErr := time.Parse("2006-01-02", old.PurchaseDate)
+	if old.PurchaseDate == "" {
+		problem("/purchaseDate", "required", "purchaseDate is required")
+	} else if dateErr != nil {
+		problem("/purchaseDate", "invalid_date",
+			"purchaseDate must be a real date written like 2022-01-02, not %q", old.PurchaseDate)
+	}
+	clock, timeErr := time.Parse("15:04", old.PurchaseTime)
+	if old.PurchaseTime == "" {
+		problem("/purchaseTime", "required", "purchaseTime is required")
+	} else if timeErr != nil {
+		problem("/purchaseTime", "invalid_time",
+			"purchaseTime must be a 24-hour time written like 13:01, not %q", old.PurchaseTime)
+	}
+	if dateErr == nil && timeErr == nil {
+		new.purchaseDatetime = time.Date(date.Year(), date.Month(), date.Day(),
+			clock.Hour(), clock.Minute(), 0, 0, time.UTC)
 	}
-	new.purchaseDatetime = datetime
 
 	// Validate and copy over the total price on the receipt
-	match = priceRegex.MatchString(old.Total)
-	if !match {
-		return receipt{}, false
+	if old.Total == "" {
+		problem("/total", "required", "total is required")
+	} else if cents, ok := parseCents(old.Total); !ok {
+		problem("/total", "invalid_price",
+			"total must be written with exactly two decimal places, like 6.49, not %q", old.Total)
+	} else {
+		new.cents = cents
 	}
-	cents, _ := strconv.Atoi(old.Total[:len(old.Total)-3] + old.Total[len(old.Total)-2:])
-	new.cents = cents
 
-	// Enforce the rule that receipts must have at least one item
-	if len(old.Items) == 0 {
-		return receipt{}, false
+	// Enforce the rule that receipts must have at least one item, and don't
+	// bother going through the items of a receipt with far too many
+	oldItems := old.Items
+	if len(oldItems) == 0 {
+		problem("/items", "required", "items must contain at least one item")
+	} else if len(oldItems) > maxItems {
+		problem("/items", "too_many_items",
+			"items may contain at most %d items, not %d", maxItems, len(oldItems))
+		oldItems = nil
 	}
 
-	for _, oldItem := range old.Items {
+	for i, oldItem := range oldItems {
 		newItem := item{}
+		path := fmt.Sprintf("/items/%d", i)
 
 		// Validate and copy over each item's description
-		match = retailerAndDescRegex.MatchString(oldItem.ShortDescription)
-		if !match {
-			return receipt{}, false
+		if oldItem.ShortDescription == "" {
+			problem(path+"/shortDescription", "required", "shortDescription is required")
+		} else if !retailerAndDescRegex.MatchString(oldItem.ShortDescription) {
+			problem(path+"/shortDescription", "invalid_characters",
+				"shortDescription may only contain letters, digits, spaces, '-' and '&'")
 		}
 		newItem.shortDescription = oldItem.ShortDescription
 
 		// Validate and copy over each item's price
-		match = priceRegex.MatchString(oldItem.Price)
-		if !match {
-			return receipt{}, false
+		if oldItem.Price == "" {
+			problem(path+"/price", "required", "price is required")
+		} else if cents, ok := parseCents(oldItem.Price); !ok {
+			problem(path+"/price", "invalid_price",
+				"price must be written with exactly two decimal places, like 6.49, not %q", oldItem.Price)
+		} else {
+			newItem.cents = cents
 		}
-		cents, _ = strconv.Atoi(oldItem.Price[:len(oldItem.Price)-3] + oldItem.Price[len(oldItem.Price)-2:])
-		newItem.cents = cents
 
 		new.items = append(new.items, newItem)
 	}
 
+	// The total can only be compared with the items once every price is known
+	if len(problems) == 0 {
+		if mismatch, ok := checkTotal(new); !ok {
+			problems = append(problems, mismatch)
+		}
+	}
+
+	if len(problems) > 0 {
+		return receipt{}, problems
+	}
+
 	// If all validation succeeds, return the new receipt instance
-	return new, true
+	return new, nil
 
 }
 
-// Handler for GET requests to /receipts/{id}/points
+// Handler for GET requests to /receipts/{id}, which returns the stored receipt
+// in the same shape in which it was submitted
+func getReceipt(w http.ResponseWriter, req *http.Request) {
+
+	id := strings.Split(req.URL.Path, "/")[2]
+
+	scored, err := store.Get(id)
+	if errors.Is(err, errReceiptNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No receipt found for that ID.")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipt could not be read.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scored.receipt.toRaw())
+
+}
+
+// Handler for GET requests to /receipts/{id}/points. A voided receipt has no
+// points, and gets a 410 to tell it apart from one that was never stored.
 func getPoints(w http.ResponseWriter, req *http.Request) {
 
 	id := strings.Split(req.URL.Path, "/")[2]
 
-	if points, present := receiptPoints[id]; !present {
+	scored, err := store.Get(id)
+	if errors.Is(err, errReceiptNotFound) {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "No receipt found for that ID.")
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipt could not be read.")
+	} else if scored.void != nil {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "That receipt was voided on %s: %s", scored.void.VoidedAt.Format(time.RFC3339), scored.void.Reason)
 	} else {
-		fmt.Fprintf(w, "{ \"points\": %d }", points)
+		fmt.Fprintf(w, "{ \"points\": %d }", scored.points)
 	}
 
 }
 
-// Sets up the handlers for the POST and GET requests and begins listening for
-// said requests on port 8080
+/*
+BreakdownResponse is the body returned for GET requests to
+/receipts/{id}/breakdown. Points is always the sum of the breakdown's points,
+which are the points the receipt earned before it was voided if Void is
+present.
+*/
+type BreakdownResponse struct {
+	Id               string            `json:"id"`
+	IdStrategy       string            `json:"idStrategy"`
+	Points           int               `json:"points"`
+	RuleSetVersion   int               `json:"ruleSetVersion"`
+	Breakdown        []RuleResult      `json:"breakdown"`
+	TotalDiscrepancy *TotalDiscrepancy `json:"totalDiscrepancy,omitempty"`
+	Void             *ReceiptVoid      `json:"void,omitempty"`
+}
+
+// Handler for GET requests to /receipts/{id}/breakdown
+func getBreakdown(w http.ResponseWriter, req *http.Request) {
+
+	id := strings.Split(req.URL.Path, "/")[2]
+
+	scored, err := store.Get(id)
+	if errors.Is(err, errReceiptNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No receipt found for that ID.")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipt could not be read.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BreakdownResponse{
+		Id:               id,
+		IdStrategy:       scored.idStrategy,
+		Points:           scored.points,
+		RuleSetVersion:   scored.ruleSetVersion,
+		Breakdown:        scored.breakdown,
+		TotalDiscrepancy: totalDiscrepancy(scored.receipt),
+		Void:             scored.void,
+	})
+
+}
+
+// Runs the subcommand named on the command line (see cli.go), or the server
+// if there isn't one
 func main() {
 
-	http.HandleFunc("POST /receipts/process", processReceipt)
-	http.HandleFunc("GET /receipts/{id}/points", getPoints)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "score":
+			os.Exit(runScore(os.Args[2:]))
+		}
+	}
+	os.Exit(runServer(os.Args[1:]))
 
-	fmt.Println("Server listening on localhost:8080.")
+}
 
-	http.ListenAndServe("localhost:8080", nil)
+// Sets up the handlers for the POST and GET requests and begins listening for
+// said requests, on localhost:8080 unless configured otherwise (see
+// server_config.go). If a rule config file is given with -rules, the scoring
+// rules are built from it instead of the spec's defaults, and are rebuilt from
+// it whenever the process receives a SIGHUP. On SIGINT or SIGTERM the server
+// shuts down gracefully (see shutdown.go). Returns the exit status.
+func runServer(args []string) int {
+
+	flags := flag.NewFlagSet("receipt_processor", flag.ExitOnError)
+	storeKind, storePath := addStoreFlags(flags, "memory")
+	addScoringFlags(flags)
+	addServerFlags(flags)
+	addLimitFlags(flags)
+	addExpiryFlags(flags)
+	flags.Parse(args)
+
+	config, err := loadServerConfig(flags, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validateLimits(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setUpScoring(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setUpExpiry(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setUpStore(*storeKind, *storePath); err != nil {
+		log.Fatal(err)
+	}
+	reloadRulesOnSighup()
+
+	http.HandleFunc("POST /receipts/process", processReceipt)
+	http.HandleFunc("POST /receipts/score", scoreReceipt)
+	http.HandleFunc("POST /receipts/batch", processBatch)
+	http.HandleFunc("GET /receipts", listReceipts)
+	http.HandleFunc("GET /receipts/{id}", getReceipt)
+	http.HandleFunc("DELETE /receipts/{id}", deleteReceipt)
+	http.HandleFunc("GET /receipts/{id}/points", getPoints)
+	http.HandleFunc("GET /receipts/{id}/breakdown", getBreakdown)
+	http.HandleFunc("GET /accounts/{id}/balance", getAccountBalance)
+	http.HandleFunc("GET /accounts/{id}/receipts", getAccountReceipts)
+	http.HandleFunc("GET /accounts/{id}/ledger", getAccountLedger)
+	http.HandleFunc("POST /accounts/{id}/redemptions", postRedemption)
+	http.HandleFunc("GET /accounts/{id}/expirations", getAccountExpirations)
+	http.HandleFunc("GET /admin/rules", getRules)
+	http.HandleFunc("POST /admin/rules/reload", postReloadRules)
+	http.HandleFunc("POST /admin/rescore", postRescore)
+
+	server := config.server(nil)
+	serve := server.ListenAndServe
+	if config.usesTLS() {
+		fmt.Printf("Server listening on %s (HTTPS).\n", config.Addr)
+		serve = func() error { return server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile) }
+	} else {
+		fmt.Printf("Server listening on %s.\n", config.Addr)
+	}
+	var stopSweeper func()
+	if expiry.enabled() {
+		stopSweeper = startExpirySweeper(expirySweepInterval)
+	}
+	return serveUntilStopped(server, serve, notifyOnStop(), config.shutdownTimeout(), stopSweeper)
 
 }
@@ -7,6 +7,7 @@ import (
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 )
 
@@ -22,11 +23,8 @@ type GetResponse struct {
 	Points int64 `json:"points"`
 }
 
-// Does the heavy lifting for all of the successful-path tests. Sends the
-// payload in via a POST request, reads the ID from the response, and sends
-// that back in with a GET request, checking that the number of points returned
-// matches the expected amount.
-func testPostAndGetHelper(t *testing.T, payload []byte, expected int64) {
+// Sends the payload in via a POST request and returns the ID from the response
+func testPostHelper(t *testing.T, payload []byte) string {
 
 	// Prepare and send the POST request
 	req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewBuffer(payload))
@@ -45,19 +43,31 @@ func testPostAndGetHelper(t *testing.T, payload []byte, expected int64) {
 		t.Errorf("Invalid JSON on POST: %s", err)
 	}
 
+	return pr.Id
+
+}
+
+// Does the heavy lifting for all of the successful-path tests. Sends the
+// payload in via a POST request, reads the ID from the response, and sends
+// that back in with a GET request, checking that the number of points returned
+// matches the expected amount.
+func testPostAndGetHelper(t *testing.T, payload []byte, expected int64) {
+
+	id := testPostHelper(t, payload)
+
 	// Prepare and send the GET request
-	getPath := "/receipts/" + pr.Id + "/points"
-	req = httptest.NewRequest(http.MethodGet, getPath, nil)
-	w = httptest.NewRecorder()
+	getPath := "/receipts/" + id + "/points"
+	req := httptest.NewRequest(http.MethodGet, getPath, nil)
+	w := httptest.NewRecorder()
 
 	getPoints(w, req)
 
 	// Unpack the response to the GET request into a GetResponse
-	resp = w.Result()
-	data, _ = io.ReadAll(resp.Body)
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
 
 	var gr GetResponse
-	err = json.Unmarshal(data, &gr)
+	err := json.Unmarshal(data, &gr)
 	if err != nil {
 		// Note error if we don't get a valid response
 		t.Errorf("Invalid JSON on GET: %s", err)
@@ -71,8 +81,8 @@ func testPostAndGetHelper(t *testing.T, payload []byte, expected int64) {
 }
 
 // Facilitates the actual POST request part of all of the badly-formatted input
-// failure tests
-func testBadPostHelper(t *testing.T, payload []byte) {
+// failure tests. Returns the problems reported with the receipt.
+func testBadPostHelper(t *testing.T, payload []byte) []ValidationError {
 
 	// Prepare and send the POST request
 	req := httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewBuffer(payload))
@@ -81,16 +91,47 @@ func testBadPostHelper(t *testing.T, payload []byte) {
 	processReceipt(w, req)
 
 	// Since our expectation in this case is to receive a 400 BadRequest, note
-	// error if we *don't* receive one or if the error message is wrong
+	// error if we *don't* receive one or if the error body is wrong
 	resp := w.Result()
 	data, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusBadRequest {
 		t.Errorf("BadRequest header expected but not returned")
 	}
-	if string(data) != "The receipt is invalid." {
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON content type but got %q", resp.Header.Get("Content-Type"))
+	}
+
+	var er ErrorResponse
+	err := json.Unmarshal(data, &er)
+	if err != nil {
+		t.Errorf("Invalid JSON in error response: %s", err)
+	}
+	if er.Message != "The receipt is invalid." || len(er.Errors) == 0 {
 		t.Errorf("Error message missing or incorrect.")
 	}
 
+	return er.Errors
+
+}
+
+// Checks that exactly the expected problems, identified by path and code,
+// were reported
+func expectProblems(t *testing.T, problems []ValidationError, expected ...ValidationError) {
+
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems but got %+v", len(expected), problems)
+		return
+	}
+	for i := range expected {
+		if problems[i].Path != expected[i].Path || problems[i].Code != expected[i].Code {
+			t.Errorf("Expected problem %s (%s) but got %s (%s)", expected[i].Path,
+				expected[i].Code, problems[i].Path, problems[i].Code)
+		}
+		if problems[i].Message == "" {
+			t.Errorf("Problem %s has no message", problems[i].Path)
+		}
+	}
+
 }
 
 // SUCCESSFUL PATH TESTS START HERE
@@ -463,6 +504,182 @@ func TestOneWithEverything(t *testing.T) {
 
 }
 
+func TestBreakdown(t *testing.T) {
+
+	payload := []byte(`{
+		"retailer": "M&M Corner Market",
+		"purchaseDate": "2022-03-20",
+		"purchaseTime": "14:33",
+		"items": [
+			{"shortDescription": "Gatorade","price": "2.25"},
+			{"shortDescription": "Gatorade","price": "2.25"},
+			{"shortDescription": "Gatorade","price": "2.25"},
+			{"shortDescription": "Gatorade","price": "2.25"}
+		],
+		"total": "9.00"
+	}`)
+	id := testPostHelper(t, payload)
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/breakdown", nil)
+	w := httptest.NewRecorder()
+
+	getBreakdown(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+
+	var br BreakdownResponse
+	err := json.Unmarshal(data, &br)
+	if err != nil {
+		t.Fatalf("Invalid JSON on GET: %s", err)
+	}
+
+	// The breakdown must account for every point awarded to the receipt
+	total := 0
+	for _, result := range br.Breakdown {
+		total += result.Points
+	}
+	if br.Points != 109 || total != br.Points {
+		t.Errorf("Expected 109 points in total but got %v, with breakdown summing to %v", br.Points, total)
+	}
+
+	first := br.Breakdown[0]
+	if first.Rule != "retailerName" || first.Points != 14 ||
+		first.Reason != "14 alphanumeric characters in 'M&M Corner Market'" {
+		t.Errorf("Unexpected retailerName result: %+v", first)
+	}
+
+}
+
+func TestGetReceipt(t *testing.T) {
+
+	payload := []byte(`{
+		"retailer": "Target",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "13:01",
+		"items": [
+			{"shortDescription": "Mountain Dew 12PK","price": "6.49"},
+			{"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ","price": "12.00"}
+		],
+		"total": "18.49"
+	}`)
+	id := testPostHelper(t, payload)
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+id, nil)
+	w := httptest.NewRecorder()
+
+	getReceipt(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+
+	var got, expected RawReceipt
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Invalid JSON on GET: %s", err)
+	}
+	json.Unmarshal(payload, &expected)
+
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON content type but got %q", resp.Header.Get("Content-Type"))
+	}
+	if got.Retailer != expected.Retailer || got.PurchaseDate != expected.PurchaseDate ||
+		got.PurchaseTime != expected.PurchaseTime || got.Total != expected.Total ||
+		len(got.Items) != len(expected.Items) {
+		t.Fatalf("Expected %+v but got %+v", expected, got)
+	}
+	for i := range got.Items {
+		if got.Items[i] != expected.Items[i] {
+			t.Errorf("Expected item %+v but got %+v", expected.Items[i], got.Items[i])
+		}
+	}
+
+}
+
+func TestScoreWithoutStoring(t *testing.T) {
+
+	useFreshStore(t)
+
+	payload := []byte(`{
+		"retailer": "Fetch",
+		"purchaseDate": "2025-01-03",
+		"purchaseTime": "15:00",
+		"total": "10.00",
+		"items": [
+			{"shortDescription": "Thing1", "price": "4.00"},
+			{"shortDescription": "Thing2", "price": "6.00"}
+		]
+	}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/score", bytes.NewBuffer(payload))
+	w := httptest.NewRecorder()
+
+	scoreReceipt(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+
+	var sr ScoreResponse
+	if err := json.Unmarshal(data, &sr); err != nil {
+		t.Fatalf("Invalid JSON on POST: %s", err)
+	}
+	total := 0
+	for _, result := range sr.Breakdown {
+		total += result.Points
+	}
+	if sr.Points != 104 || total != sr.Points {
+		t.Errorf("Expected 104 points in total but got %v, with breakdown summing to %v", sr.Points, total)
+	}
+
+	if ids, _ := store.List(); len(ids) != 0 {
+		t.Errorf("Scoring a receipt should not store it, but found %v", ids)
+	}
+
+}
+
+func TestScoreInvalidReceipt(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/score", bytes.NewBufferString(`{"retailer": "Target"}`))
+	w := httptest.NewRecorder()
+
+	scoreReceipt(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("BadRequest header expected but not returned")
+	}
+
+}
+
+// Hammers the POST and GET handlers from many goroutines at once. Run with
+// -race to check that the handlers and the store are safe for concurrent use.
+func TestConcurrentPostAndGet(t *testing.T) {
+
+	payload := []byte(`{
+		"retailer": "Target",
+		"purchaseDate": "2022-01-02",
+		"purchaseTime": "13:13",
+		"total": "1.25",
+		"items": [
+			{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}
+		]
+	}`)
+
+	const workers = 16
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				testPostAndGetHelper(t, payload, 31)
+			}
+		}()
+	}
+	wg.Wait()
+
+}
+
 // FAILURE PATH TESTS START HERE
 
 func TestMissingElement(t *testing.T) {
@@ -474,7 +691,8 @@ func TestMissingElement(t *testing.T) {
 		"total": "2.65",
 	}`)
 
-	testBadPostHelper(t, payload)
+	problems := testBadPostHelper(t, payload)
+	expectProblems(t, problems, ValidationError{Path: "", Code: "malformed_json"})
 
 }
 
@@ -700,6 +918,88 @@ func TestBadItemPrice2(t *testing.T) {
 
 }
 
+func TestMissingReceipt(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/receipts/fake-id", nil)
+	w := httptest.NewRecorder()
+
+	getReceipt(w, req)
+
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("NotFound header expected but not returned")
+	}
+}
+
+func TestMissingBreakdown(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/receipts/fake-id/breakdown", nil)
+	w := httptest.NewRecorder()
+
+	getBreakdown(w, req)
+
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("NotFound header expected but not returned")
+	}
+}
+
+func TestEveryProblemReported(t *testing.T) {
+
+	payload := []byte(`{
+		"retailer": "Walgreens<",
+		"purchaseDate": "2022-02-29",
+		"purchaseTime": "25:13",
+		"total": "2.657",
+		"items": [
+			{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+			{"shortDescription": "", "price": "1.40"},
+			{"shortDescription": "Dasani", "price": "140"}
+		]
+	}`)
+
+	problems := testBadPostHelper(t, payload)
+	expectProblems(t, problems,
+		ValidationError{Path: "/retailer", Code: "invalid_characters"},
+		ValidationError{Path: "/purchaseDate", Code: "invalid_date"},
+		ValidationError{Path: "/purchaseTime", Code: "invalid_time"},
+		ValidationError{Path: "/total", Code: "invalid_price"},
+		ValidationError{Path: "/items/1/shortDescription", Code: "required"},
+		ValidationError{Path: "/items/2/price", Code: "invalid_price"},
+	)
+
+}
+
+func TestWrongType(t *testing.T) {
+
+	payload := []byte(`{
+		"retailer": "Walgreens",
+		"purchaseDate": "2022-01-02",
+		"purchaseTime": "08:13",
+		"total": 2.65,
+		"items": [
+			{"shortDescription": "Pepsi - 12-oz", "price": "1.25"},
+			{"shortDescription": "Dasani", "price": "1.40"}
+		]
+	}`)
+
+	problems := testBadPostHelper(t, payload)
+	expectProblems(t, problems, ValidationError{Path: "/total", Code: "invalid_type"})
+
+}
+
+func TestBodyNotObject(t *testing.T) {
+
+	cases := map[string]string{
+		`[]`:  "expected JSON object but got JSON array",
+		`"x"`: "expected JSON object but got JSON string",
+	}
+	for payload, message := range cases {
+		problems := testBadPostHelper(t, []byte(payload))
+		expectProblems(t, problems, ValidationError{Path: "", Code: "invalid_type"})
+		if len(problems) == 1 && problems[0].Message != message {
+			t.Errorf("Expected %q for %s but got %q", message, payload, problems[0].Message)
+		}
+	}
+
+}
+
 func TestMissingGet(t *testing.T) {
 	getPath := "/receipts/fake-id/points"
 	req := httptest.NewRequest(http.MethodGet, getPath, nil)
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+receiptFilter narrows down the receipts listed by GET /receipts. Each field is
+set from a query parameter, and a receipt must match every one given:
+
+  - retailer: the retailer's name, ignoring case
+  - minPurchaseDate, maxPurchaseDate: purchased on or between these dates,
+    written like 2022-01-02
+  - minTotal, maxTotal: a total within these amounts, written like 2.65
+  - minPoints, maxPoints: awarded points within these numbers
+  - item: some item's short description contains this text, ignoring case
+
+Bounds are inclusive, and a nil bound (or empty text) matches everything.
+*/
+type receiptFilter struct {
+	retailer  string
+	item      string
+	minDate   *time.Time
+	maxDate   *time.Time
+	minTotal  *int
+	maxTotal  *int
+	minPoints *int
+	maxPoints *int
+}
+
+// Reads the filter query parameters from a request, reporting every one that
+// can't be understood
+func readReceiptFilter(req *http.Request) (receiptFilter, error) {
+
+	query := req.URL.Query()
+	filter := receiptFilter{
+		retailer: query.Get("retailer"),
+		item:     strings.ToLower(query.Get("item")),
+	}
+
+	var problems []error
+	date := func(name string) *time.Time {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s must be a date written like 2022-01-02, not %q", name, value))
+			return nil
+		}
+		return &parsed
+	}
+	amount := func(name string) *int {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		cents, ok := parseCents(value)
+		if !ok {
+			problems = append(problems, fmt.Errorf("%s must be an amount written like 2.65, not %q", name, value))
+			return nil
+		}
+		return &cents
+	}
+	number := func(name string) *int {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s must be a whole number, not %q", name, value))
+			return nil
+		}
+		return &n
+	}
+
+	filter.minDate, filter.maxDate = date("minPurchaseDate"), date("maxPurchaseDate")
+	filter.minTotal, filter.maxTotal = amount("minTotal"), amount("maxTotal")
+	filter.minPoints, filter.maxPoints = number("minPoints"), number("maxPoints")
+
+	if filter.minDate != nil && filter.maxDate != nil && filter.minDate.After(*filter.maxDate) {
+		problems = append(problems, errors.New("minPurchaseDate is after maxPurchaseDate"))
+	}
+	if filter.minTotal != nil && filter.maxTotal != nil && *filter.minTotal > *filter.maxTotal {
+		problems = append(problems, errors.New("minTotal is more than maxTotal"))
+	}
+	if filter.minPoints != nil && filter.maxPoints != nil && *filter.minPoints > *filter.maxPoints {
+		problems = append(problems, errors.New("minPoints is more than maxPoints"))
+	}
+	return filter, errors.Join(problems...)
+
+}
+
+// Reports whether a stored receipt passes the filter
+func (f receiptFilter) matches(scored scoredReceipt) bool {
+
+	r := scored.receipt
+	if f.retailer != "" && !strings.EqualFold(r.retailer, f.retailer) {
+		return false
+	}
+
+	// The purchase date is compared on its own, so that the whole of the
+	// last day is included
+	day := time.Date(r.purchaseDatetime.Year(), r.purchaseDatetime.Month(), r.purchaseDatetime.Day(), 0, 0, 0, 0, time.UTC)
+	if (f.minDate != nil && day.Before(*f.minDate)) || (f.maxDate != nil && day.After(*f.maxDate)) {
+		return false
+	}
+
+	if (f.minTotal != nil && r.cents < *f.minTotal) || (f.maxTotal != nil && r.cents > *f.maxTotal) {
+		return false
+	}
+	if (f.minPoints != nil && scored.points < *f.minPoints) || (f.maxPoints != nil && scored.points > *f.maxPoints) {
+		return false
+	}
+
+	if f.item != "" {
+		for _, item := range r.items {
+			if strings.Contains(strings.ToLower(item.shortDescription), f.item) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+
+}
+
+/*
+Handler for GET requests to /receipts, which returns a page of every stored
+receipt (see pagination.go) that passes the filters in the query string (see
+receiptFilter). Filters are checked against the stored receipt, so amounts
+and dates are compared by value rather than as they were written. The cursor
+doesn't carry the filters, so they must be passed again with it to get the
+next page of the same list.
+*/
+func listReceipts(w http.ResponseWriter, req *http.Request) {
+
+	page, err := readPageRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	filter, err := readReceiptFilter(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipts could not be listed.")
+		return
+	}
+
+	result, err := buildReceiptPage(ids, page, filter.matches)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipts could not be read.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// Lists the receipts matching the query and returns the page
+func testListReceiptsHelper(t *testing.T, query string) ReceiptPage {
+
+	w := testGetAccountHelper(t, listReceipts, "/receipts?"+query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected OK for %q but got %v: %s", query, w.Code, w.Body)
+	}
+	var page ReceiptPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Invalid JSON on receipt list: %s", err)
+	}
+	return page
+
+}
+
+func TestListReceipts(t *testing.T) {
+
+	useFreshStore(t)
+
+	// Target on 2022-01-02 for 1.25 (31 points), "a" on 2025-01-03 for 0.01
+	// (7 points) and Target on 2022-01-03 for 1.25 (37 points)
+	a := testPostHelper(t, []byte(batchReceiptA))
+	b := testPostHelper(t, []byte(batchReceiptB))
+	c := testPostHelper(t, []byte(accountPayload("03")))
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{b, c, a}},
+		{"retailer=target", []string{c, a}},
+		{"item=PEPSI", []string{c, a}},
+		{"item=nothing", []string{}},
+		{"minPurchaseDate=2022-01-03&maxPurchaseDate=2022-01-03", []string{c}},
+		{"maxPurchaseDate=2022-12-31", []string{c, a}},
+		{"maxTotal=1.00", []string{b}},
+		{"minTotal=1.25&maxTotal=1.25", []string{c, a}},
+		{"minPoints=31&maxPoints=31", []string{a}},
+		{"minPoints=30&retailer=Target&item=12-oz", []string{c, a}},
+	}
+	for _, tc := range cases {
+		page := testListReceiptsHelper(t, tc.query)
+		ids := []string{}
+		for _, summary := range page.Receipts {
+			ids = append(ids, summary.Id)
+		}
+		if !reflect.DeepEqual(ids, tc.expected) || page.NextCursor != "" {
+			t.Errorf("%q: expected %v but got %v", tc.query, tc.expected, page)
+		}
+	}
+
+	// Filters apply to every page
+	first := testListReceiptsHelper(t, "retailer=Target&limit=1")
+	if len(first.Receipts) != 1 || first.Receipts[0].Id != c || first.NextCursor == "" {
+		t.Fatalf("Unexpected first page %+v", first)
+	}
+	second := testListReceiptsHelper(t, "retailer=Target&limit=1&cursor="+url.QueryEscape(first.NextCursor))
+	if len(second.Receipts) != 1 || second.Receipts[0].Id != a || second.NextCursor != "" {
+		t.Errorf("Unexpected second page %+v", second)
+	}
+
+}
+
+func TestListReceiptsBadQuery(t *testing.T) {
+
+	useFreshStore(t)
+
+	for _, query := range []string{
+		"minTotal=1",
+		"maxPurchaseDate=2022-13-01",
+		"minPoints=ten",
+		"minPoints=5&maxPoints=1",
+		"minPurchaseDate=2022-02-01&maxPurchaseDate=2022-01-01",
+		"limit=0",
+		"cursor=nonsense",
+	} {
+		if w := testGetAccountHelper(t, listReceipts, "/receipts?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected BadRequest for %q but got %v", query, w.Code)
+		}
+	}
+
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/*
+RescoreResponse is the body returned for POST requests to /admin/rescore. It
+lists, for every stored receipt that hasn't been voided, the points it was
+awarded and the points it would be awarded under the chosen rule set.
+*/
+type RescoreResponse struct {
+	RuleSetVersion int               `json:"ruleSetVersion"`
+	Source         string            `json:"source"`
+	Committed      bool              `json:"committed"`
+	Changed        int               `json:"changed"`
+	Receipts       []RescoredReceipt `json:"receipts"`
+}
+
+type RescoredReceipt struct {
+	Id                string `json:"id"`
+	OldPoints         int    `json:"oldPoints"`
+	NewPoints         int    `json:"newPoints"`
+	OldRuleSetVersion int    `json:"oldRuleSetVersion"`
+}
+
+/*
+Replays every stored receipt through the given rule set. When commit is true
+the new scores replace the old ones in the store, along with the version of
+the rule set that produced them.
+*/
+func rescoreReceipts(set *ruleSet, commit bool) (RescoreResponse, error) {
+
+	resp := RescoreResponse{
+		RuleSetVersion: set.version,
+		Source:         set.source,
+		Committed:      commit,
+		Receipts:       []RescoredReceipt{},
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		return RescoreResponse{}, err
+	}
+
+	for _, id := range ids {
+		scored, err := store.Get(id)
+		if errors.Is(err, errReceiptNotFound) {
+			// Deleted since the list was taken
+			continue
+		} else if err != nil {
+			return RescoreResponse{}, err
+		}
+		if scored.void != nil {
+			// Voided receipts keep the score they had, for the record, but
+			// earn nothing whatever the rules
+			continue
+		}
+
+		points, breakdown := set.registry.Breakdown(scored.receipt)
+		resp.Receipts = append(resp.Receipts, RescoredReceipt{
+			Id:                id,
+			OldPoints:         scored.points,
+			NewPoints:         points,
+			OldRuleSetVersion: scored.ruleSetVersion,
+		})
+		if points != scored.points {
+			resp.Changed++
+		}
+
+		if commit {
+			scored.points = points
+			scored.breakdown = breakdown
+			scored.ruleSetVersion = set.version
+			if err := store.Save(id, scored); errors.Is(err, errReceiptVoided) {
+				// Voided since it was read
+				continue
+			} else if err != nil {
+				return RescoreResponse{}, err
+			}
+		}
+	}
+
+	return resp, nil
+
+}
+
+/*
+Handler for POST requests to /admin/rescore
+
+With an empty body, stored receipts are replayed through the active rules.
+Otherwise the body is taken to be a candidate rule config, in the same format
+as the -rules file, and receipts are replayed through that instead.
+
+Nothing is changed unless the query string includes commit=true. Committing
+scores from a candidate config also makes the candidate the active rule set,
+so that receipts submitted from then on are scored the same way as the ones
+already stored. The candidate only becomes active once every receipt has been
+rescored; if rescoring fails part way, the receipts rescored so far keep their
+new scores but the rules stay as they were, and the commit can be retried.
+
+A candidate lives only in memory, so committing one is refused with a 409
+when the rules are loaded from a -rules file: the next reload would quietly
+replace it with the file's rules. Change the file and reload instead. Without
+-rules a committed candidate is kept until the next reload, which goes back
+to the spec's default rules.
+*/
+func postRescore(w http.ResponseWriter, req *http.Request) {
+
+	commit := req.URL.Query().Get("commit") == "true"
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "The request body is larger than the limit of %d bytes.", tooLarge.Limit)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The request body could not be read.")
+		return
+	}
+
+	set := activeRules.Load()
+	var candidate *RuleRegistry
+	if len(bytes.TrimSpace(data)) > 0 {
+		config, err := parseRuleConfig(data)
+		if err == nil {
+			candidate, err = config.registry()
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprintf(w, "The candidate rule config is invalid: %s", err)
+			return
+		}
+		if commit && rulesPath != "" {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "The rules are loaded from %s, which the next reload would go back to. Change the file and reload instead of committing a candidate.", rulesPath)
+			return
+		}
+		set = &ruleSet{version: 0, registry: candidate, source: "rescore candidate"}
+	}
+
+	var resp RescoreResponse
+	if commit && candidate != nil {
+		_, err = activateRulesAfter(candidate, "rescore candidate", func(next *ruleSet) error {
+			var err error
+			resp, err = rescoreReceipts(next, true)
+			return err
+		})
+	} else {
+		resp, err = rescoreReceipts(set, commit)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipts could not be rescored: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Sends a rescore request with the given candidate config and query string
+func testRescoreHelper(t *testing.T, query string, candidate string) RescoreResponse {
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/rescore"+query, bytes.NewBufferString(candidate))
+	w := httptest.NewRecorder()
+
+	postRescore(w, req)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected OK but got %v: %s", resp.StatusCode, data)
+	}
+
+	var rr RescoreResponse
+	if err := json.Unmarshal(data, &rr); err != nil {
+		t.Fatalf("Invalid JSON on rescore: %s", err)
+	}
+	return rr
+
+}
+
+func TestRescoreCandidate(t *testing.T) {
+
+	useFreshStore(t)
+	useRulesPath(t, "")
+
+	roundId := testPostHelper(t, []byte(`{
+		"retailer": "a",
+		"purchaseDate": "2025-01-02",
+		"purchaseTime": "00:00",
+		"total": "1.00",
+		"items": [{"shortDescription": "item", "price": "1.00"}]
+	}`))
+	testPostHelper(t, []byte(`{
+		"retailer": "a",
+		"purchaseDate": "2025-01-02",
+		"purchaseTime": "00:00",
+		"total": "0.01",
+		"items": [{"shortDescription": "item", "price": "0.01"}]
+	}`))
+	candidate := `{"noCentsBonus": {"points": 100}}`
+
+	// A dry run reports the difference without touching the store
+	rr := testRescoreHelper(t, "", candidate)
+	if rr.Committed || rr.Changed != 1 || len(rr.Receipts) != 2 {
+		t.Fatalf("Unexpected dry run result: %+v", rr)
+	}
+	for _, r := range rr.Receipts {
+		if r.Id == roundId && (r.OldPoints != 1+50+25 || r.NewPoints != 1+100+25) {
+			t.Errorf("Unexpected rescore of round dollar receipt: %+v", r)
+		}
+	}
+	if points, _ := store.GetPoints(roundId); points != 1+50+25 {
+		t.Errorf("Dry run changed stored points to %v", points)
+	}
+
+	// Committing stores the new scores and activates the candidate
+	before := activeRules.Load().version
+	rr = testRescoreHelper(t, "?commit=true", candidate)
+	if !rr.Committed || rr.RuleSetVersion != before+1 || activeRules.Load().version != before+1 {
+		t.Fatalf("Unexpected commit result: %+v", rr)
+	}
+	scored, _ := store.Get(roundId)
+	if scored.points != 1+100+25 || scored.ruleSetVersion != before+1 {
+		t.Errorf("Commit did not update the stored receipt: %+v", scored)
+	}
+
+	// Rescoring again under the now-active rules changes nothing
+	if rr = testRescoreHelper(t, "", ""); rr.Changed != 0 {
+		t.Errorf("Expected no changes but got %v", rr.Changed)
+	}
+
+}
+
+func TestRescoreInvalidCandidate(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/rescore", bytes.NewBufferString(`{"numItems": {"itemsPerGroup": 0}}`))
+	w := httptest.NewRecorder()
+
+	postRescore(w, req)
+
+	if w.Result().StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("UnprocessableEntity header expected but not returned")
+	}
+
+}
+
+func TestRescoreCandidateWithRulesFile(t *testing.T) {
+
+	useFreshStore(t)
+	useRuleConfigFile(t, `{}`)
+	before := activeRules.Load()
+
+	// The dry run is fine, but a commit would be undone by the next reload
+	testRescoreHelper(t, "", `{"noCentsBonus": {"points": 100}}`)
+	req := httptest.NewRequest(http.MethodPost, "/admin/rescore?commit=true", bytes.NewBufferString(`{"noCentsBonus": {"points": 100}}`))
+	w := httptest.NewRecorder()
+	postRescore(w, req)
+	if w.Code != http.StatusConflict || activeRules.Load() != before {
+		t.Errorf("Expected Conflict with the rules untouched but got %v: %s", w.Code, w.Body)
+	}
+
+}
+
+// A store whose saves always fail
+type failingSaveStore struct {
+	ReceiptStore
+}
+
+func (failingSaveStore) Save(string, scoredReceipt) error {
+	return errors.New("disk full")
+}
+
+func TestRescoreCommitFailure(t *testing.T) {
+
+	useFreshStore(t)
+	useRulesPath(t, "")
+	testPostHelper(t, []byte(batchReceiptA))
+	store = failingSaveStore{store}
+	before := activeRules.Load()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/rescore?commit=true", bytes.NewBufferString(`{"noCentsBonus": {"points": 100}}`))
+	w := httptest.NewRecorder()
+	postRescore(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected InternalServerError but got %v: %s", w.Code, w.Body)
+	}
+	if activeRules.Load() != before {
+		t.Errorf("Expected the candidate not to be activated")
+	}
+
+	// The failed candidate's version isn't handed out again
+	set, err := activateRules(defaultRuleConfig(), "defaults")
+	if err != nil || set.version != before.version+2 {
+		t.Errorf("Expected version %v but got %+v (error %v)", before.version+2, set, err)
+	}
+
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/*
+RuleConfig parameterises the scoring rules. It is loaded from a JSON file at
+startup so that promotions can be changed without editing Go code. Any field
+left out of the file keeps the value given by the spec (see
+defaultRuleConfig), and every rule is enabled unless the file says otherwise.
+
+Order optionally lists every rule name once, in the order the rules should be
+applied. When empty, the spec's order is used.
+*/
+type RuleConfig struct {
+	Order                  []string                     `json:"order,omitempty"`
+	RetailerName           RetailerNameConfig           `json:"retailerName"`
+	NoCentsBonus           NoCentsBonusConfig           `json:"noCentsBonus"`
+	EvenQuarterBonus       EvenQuarterBonusConfig       `json:"evenQuarterBonus"`
+	NumItems               NumItemsConfig               `json:"numItems"`
+	ItemDescriptionLengths ItemDescriptionLengthsConfig `json:"itemDescriptionLengths"`
+	OddPurchaseDates       OddPurchaseDatesConfig       `json:"oddPurchaseDates"`
+	AfternoonBonus         AfternoonBonusConfig         `json:"afternoonBonus"`
+}
+
+type RetailerNameConfig struct {
+	Enabled            bool `json:"enabled"`
+	PointsPerCharacter int  `json:"pointsPerCharacter"`
+}
+
+type NoCentsBonusConfig struct {
+	Enabled bool `json:"enabled"`
+	Points  int  `json:"points"`
+}
+
+// Multiple is written the same way as prices in the API, e.g. "0.25"
+type EvenQuarterBonusConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Multiple string `json:"multiple"`
+	Points   int    `json:"points"`
+}
+
+type NumItemsConfig struct {
+	Enabled        bool `json:"enabled"`
+	ItemsPerGroup  int  `json:"itemsPerGroup"`
+	PointsPerGroup int  `json:"pointsPerGroup"`
+}
+
+type ItemDescriptionLengthsConfig struct {
+	Enabled         bool    `json:"enabled"`
+	LengthMultiple  int     `json:"lengthMultiple"`
+	PriceMultiplier float64 `json:"priceMultiplier"`
+}
+
+type OddPurchaseDatesConfig struct {
+	Enabled bool `json:"enabled"`
+	Points  int  `json:"points"`
+}
+
+// Start and End are 24-hour times, e.g. "14:00", and are both exclusive
+type AfternoonBonusConfig struct {
+	Enabled bool   `json:"enabled"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	Points  int    `json:"points"`
+}
+
+// Returns the configuration matching the rules from the spec
+func defaultRuleConfig() RuleConfig {
+
+	return RuleConfig{
+		RetailerName:           RetailerNameConfig{Enabled: true, PointsPerCharacter: 1},
+		NoCentsBonus:           NoCentsBonusConfig{Enabled: true, Points: 50},
+		EvenQuarterBonus:       EvenQuarterBonusConfig{Enabled: true, Multiple: "0.25", Points: 25},
+		NumItems:               NumItemsConfig{Enabled: true, ItemsPerGroup: 2, PointsPerGroup: 5},
+		ItemDescriptionLengths: ItemDescriptionLengthsConfig{Enabled: true, LengthMultiple: 3, PriceMultiplier: 0.2},
+		OddPurchaseDates:       OddPurchaseDatesConfig{Enabled: true, Points: 6},
+		AfternoonBonus:         AfternoonBonusConfig{Enabled: true, Start: "14:00", End: "16:00", Points: 10},
+	}
+
+}
+
+// Reads and validates the rule configuration in the file at path
+func loadRuleConfig(path string) (RuleConfig, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RuleConfig{}, fmt.Errorf("reading rule config: %w", err)
+	}
+
+	config, err := parseRuleConfig(data)
+	if err != nil {
+		return RuleConfig{}, fmt.Errorf("rule config %s: %w", path, err)
+	}
+	return config, nil
+
+}
+
+// Decodes and validates a JSON rule configuration. Unknown fields are
+// rejected so that a misspelt setting isn't silently ignored.
+func parseRuleConfig(data []byte) (RuleConfig, error) {
+
+	config := defaultRuleConfig()
+	if err := decodeConfig(data, &config); err != nil {
+		return RuleConfig{}, err
+	}
+	if err := config.validate(); err != nil {
+		return RuleConfig{}, err
+	}
+	return config, nil
+
+}
+
+// Decodes a JSON config file over the defaults already in config. Unknown
+// fields are rejected, and errors give the line and column at fault.
+func decodeConfig(data []byte, config any) error {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			line, col := lineAndColumn(data, syntaxErr.Offset)
+			return fmt.Errorf("malformed JSON at line %d, column %d: %s", line, col, syntaxErr)
+		case errors.As(err, &typeErr):
+			line, col := lineAndColumn(data, typeErr.Offset)
+			return fmt.Errorf("line %d, column %d: %s should be of type %s, not %s",
+				line, col, typeErr.Field, typeErr.Type, typeErr.Value)
+		default:
+			return fmt.Errorf("malformed JSON: %s", err)
+		}
+	}
+	if decoder.More() {
+		return errors.New("malformed JSON: unexpected data after the top-level object")
+	}
+	return nil
+
+}
+
+// Checks the configuration for values that would make a rule misbehave.
+// Every problem found is reported, rather than just the first.
+func (c RuleConfig) validate() error {
+
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Order) > 0 {
+		known := make(map[string]bool)
+		for _, name := range ruleConfigNames {
+			known[name] = true
+		}
+		seen := make(map[string]bool)
+		for _, name := range c.Order {
+			switch {
+			case !known[name]:
+				problem("order: unknown rule %q", name)
+			case seen[name]:
+				problem("order: rule %q is listed more than once", name)
+			}
+			seen[name] = true
+		}
+		for _, name := range ruleConfigNames {
+			if !seen[name] {
+				problem("order: rule %q is missing", name)
+			}
+		}
+	}
+
+	if c.RetailerName.PointsPerCharacter < 0 {
+		problem("retailerName.pointsPerCharacter must not be negative")
+	}
+	if c.NoCentsBonus.Points < 0 {
+		problem("noCentsBonus.points must not be negative")
+	}
+	if c.EvenQuarterBonus.Points < 0 {
+		problem("evenQuarterBonus.points must not be negative")
+	}
+	if cents, ok := parseCents(c.EvenQuarterBonus.Multiple); !ok || cents == 0 {
+		problem("evenQuarterBonus.multiple must be a non-zero amount like \"0.25\", not %q", c.EvenQuarterBonus.Multiple)
+	}
+	if c.NumItems.ItemsPerGroup < 1 {
+		problem("numItems.itemsPerGroup must be at least 1")
+	}
+	if c.NumItems.PointsPerGroup < 0 {
+		problem("numItems.pointsPerGroup must not be negative")
+	}
+	if c.ItemDescriptionLengths.LengthMultiple < 1 {
+		problem("itemDescriptionLengths.lengthMultiple must be at least 1")
+	}
+	if c.ItemDescriptionLengths.PriceMultiplier < 0 {
+		problem("itemDescriptionLengths.priceMultiplier must not be negative")
+	}
+	if c.OddPurchaseDates.Points < 0 {
+		problem("oddPurchaseDates.points must not be negative")
+	}
+	if c.AfternoonBonus.Points < 0 {
+		problem("afternoonBonus.points must not be negative")
+	}
+	start, startErr := parseMinute(c.AfternoonBonus.Start)
+	if startErr != nil {
+		problem("afternoonBonus.start must be a 24-hour time like \"14:00\", not %q", c.AfternoonBonus.Start)
+	}
+	end, endErr := parseMinute(c.AfternoonBonus.End)
+	if endErr != nil {
+		problem("afternoonBonus.end must be a 24-hour time like \"16:00\", not %q", c.AfternoonBonus.End)
+	}
+	if startErr == nil && endErr == nil && start >= end {
+		problem("afternoonBonus.start must be earlier than afternoonBonus.end")
+	}
+
+	return errors.Join(problems...)
+
+}
+
+// The names of the configurable rules, in the spec's order
+var ruleConfigNames = []string{
+	"retailerName",
+	"noCentsBonus",
+	"evenQuarterBonus",
+	"numItems",
+	"itemDescriptionLengths",
+	"oddPurchaseDates",
+	"afternoonBonus",
+}
+
+// Builds a registry of the enabled rules. The configuration is assumed to
+// have passed validation.
+func (c RuleConfig) registry() (*RuleRegistry, error) {
+
+	multipleCents, _ := parseCents(c.EvenQuarterBonus.Multiple)
+	startMinute, _ := parseMinute(c.AfternoonBonus.Start)
+	endMinute, _ := parseMinute(c.AfternoonBonus.End)
+
+	enabled := map[string]bool{
+		"retailerName":           c.RetailerName.Enabled,
+		"noCentsBonus":           c.NoCentsBonus.Enabled,
+		"evenQuarterBonus":       c.EvenQuarterBonus.Enabled,
+		"numItems":               c.NumItems.Enabled,
+		"itemDescriptionLengths": c.ItemDescriptionLengths.Enabled,
+		"oddPurchaseDates":       c.OddPurchaseDates.Enabled,
+		"afternoonBonus":         c.AfternoonBonus.Enabled,
+	}
+	rules := map[string]ScoringRule{
+		"retailerName": retailerNameRule{
+			pointsPerCharacter: c.RetailerName.PointsPerCharacter,
+		},
+		"noCentsBonus": noCentsBonusRule{
+			points: c.NoCentsBonus.Points,
+		},
+		"evenQuarterBonus": evenQuarterBonusRule{
+			multipleCents: multipleCents,
+			points:        c.EvenQuarterBonus.Points,
+		},
+		"numItems": numItemsRule{
+			itemsPerGroup:  c.NumItems.ItemsPerGroup,
+			pointsPerGroup: c.NumItems.PointsPerGroup,
+		},
+		"itemDescriptionLengths": itemDescriptionLengthsRule{
+			lengthMultiple:  c.ItemDescriptionLengths.LengthMultiple,
+			priceMultiplier: c.ItemDescriptionLengths.PriceMultiplier,
+		},
+		"oddPurchaseDates": oddPurchaseDatesRule{
+			points: c.OddPurchaseDates.Points,
+		},
+		"afternoonBonus": afternoonBonusRule{
+			startMinute: startMinute,
+			endMinute:   endMinute,
+			points:      c.AfternoonBonus.Points,
+		},
+	}
+
+	order := c.Order
+	if len(order) == 0 {
+		order = ruleConfigNames
+	}
+
+	reg := &RuleRegistry{}
+	for _, name := range order {
+		if !enabled[name] {
+			continue
+		}
+		if err := reg.Register(rules[name]); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+
+}
+
+// Converts an amount written like an API price, e.g. "2.65", into cents.
+// Returned bool indicates success/failure.
+func parseCents(amount string) (int, bool) {
+
+	if !regexp.MustCompile(`^\d+\.\d{2}$`).MatchString(amount) {
+		return 0, false
+	}
+	cents, err := strconv.Atoi(amount[:len(amount)-3] + amount[len(amount)-2:])
+	return cents, err == nil
+
+}
+
+// Converts a 24-hour time like "14:00" into minutes past midnight
+func parseMinute(clock string) (int, error) {
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+
+}
+
+// Translates the offset reported by a JSON error into a 1-based line and
+// column, for pointing at the location of a problem in a config file. The
+// offset counts the bytes read when the problem was found, so the offending
+// byte is the one just before it.
+func lineAndColumn(data []byte, offset int64) (int, int) {
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+
+}
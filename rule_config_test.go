@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExampleRuleConfigMatchesDefaults(t *testing.T) {
+
+	config, err := loadRuleConfig("rules.example.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	reg, _ := config.registry()
+
+	r := receipt{
+		retailer:         "M&M Corner Market",
+		purchaseDatetime: time.Date(2022, 3, 20, 14, 33, 0, 0, time.UTC),
+		items: []item{
+			{shortDescription: "Gatorade", cents: 225},
+			{shortDescription: "Gatorade", cents: 225},
+			{shortDescription: "Gatorade", cents: 225},
+			{shortDescription: "Gatorade", cents: 225},
+		},
+		cents: 900,
+	}
+	if score, expected := reg.Score(r), defaultRuleRegistry().Score(r); score != expected {
+		t.Errorf("Expected %v but got %v", expected, score)
+	}
+
+}
+
+func TestPartialRuleConfig(t *testing.T) {
+
+	config, err := parseRuleConfig([]byte(`{
+		"noCentsBonus": {"points": 75},
+		"afternoonBonus": {"enabled": false}
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	reg, _ := config.registry()
+
+	r := receipt{
+		retailer:         "a",
+		purchaseDatetime: time.Date(2025, 1, 2, 15, 0, 0, 0, time.UTC),
+		items:            []item{{shortDescription: "item", cents: 100}},
+		cents:            100,
+	}
+
+	// Unmentioned settings keep their defaults, and the afternoon bonus is off
+	var expected = 1 + // 1 per alphanumeric char in retailer
+		75 + // 75 if cents == 00
+		25 // 25 if cents divide by 25
+	if score := reg.Score(r); score != expected {
+		t.Errorf("Expected %v but got %v", expected, score)
+	}
+	if len(reg.Rules()) != 6 {
+		t.Errorf("Expected 6 enabled rules but got %v", len(reg.Rules()))
+	}
+
+}
+
+func TestRuleConfigOrder(t *testing.T) {
+
+	config, err := parseRuleConfig([]byte(`{"order": [
+		"afternoonBonus", "oddPurchaseDates", "itemDescriptionLengths",
+		"numItems", "evenQuarterBonus", "noCentsBonus", "retailerName"
+	]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	reg, _ := config.registry()
+
+	if names := ruleNames(reg); names[0] != "afternoonBonus" || names[6] != "retailerName" {
+		t.Errorf("Rules not applied in configured order: %v", names)
+	}
+
+}
+
+func TestMalformedRuleConfigs(t *testing.T) {
+
+	cases := []struct {
+		config   string
+		expected string
+	}{
+		{`{"noCentsBonus": {"points": 50,}}`, "line 1, column 32"},
+		{`{"noCentsBonus": {"points": "50"}}`, "noCentsBonus.points should be of type int"},
+		{`{"noCentsBonus": {"pionts": 50}}`, `unknown field "pionts"`},
+		{`{"numItems": {"itemsPerGroup": 0}}`, "numItems.itemsPerGroup must be at least 1"},
+		{`{"evenQuarterBonus": {"multiple": "0.2"}}`, "evenQuarterBonus.multiple"},
+		{`{"afternoonBonus": {"start": "16:00", "end": "14:00"}}`, "must be earlier than"},
+		{`{"afternoonBonus": {"start": "2pm"}}`, "afternoonBonus.start"},
+		{`{"order": ["retailerName", "retailerName"]}`, "listed more than once"},
+		{`{"order": ["bogus"]}`, `unknown rule "bogus"`},
+	}
+
+	for _, c := range cases {
+		_, err := parseRuleConfig([]byte(c.config))
+		if err == nil {
+			t.Errorf("Expected an error for %s", c.config)
+		} else if !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected error for %s to mention %q but got: %s", c.config, c.expected, err)
+		}
+	}
+
+}
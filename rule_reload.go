@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+ruleSet is one generation of scoring rules. Each time the rules are reloaded a
+new ruleSet is built with the next version number and swapped in whole, so a
+request that has already picked up a ruleSet scores against it to the end even
+if a reload happens part way through.
+*/
+type ruleSet struct {
+	version  int
+	registry *RuleRegistry
+	source   string
+	loadedAt time.Time
+}
+
+// The rule set used to score incoming receipts. Load it once per request.
+var activeRules atomic.Pointer[ruleSet]
+
+// The config file the rules are (re)loaded from. Empty means the spec's
+// default rules are used.
+var rulesPath string
+
+// Serialises reloads so that version numbers are handed out in order
+var reloadMutex sync.Mutex
+
+// The version number last handed out, which is ahead of the active rule set's
+// if a rescore failed before its candidate could be activated. Numbers are
+// never handed out twice, so receipts scored by a candidate that was never
+// activated can't be mistaken for another rule set's. Guarded by reloadMutex.
+var latestRuleSetVersion = 1
+
+func init() {
+	activeRules.Store(&ruleSet{
+		version:  1,
+		registry: defaultRuleRegistry(),
+		source:   "defaults",
+		loadedAt: time.Now(),
+	})
+}
+
+// Builds a new rule set from the config file at rulesPath (or from the spec's
+// defaults if there is none) and makes it the active one. On failure the
+// active rule set is left untouched.
+func reloadRules() (*ruleSet, error) {
+
+	config := defaultRuleConfig()
+	source := "defaults"
+	if rulesPath != "" {
+		var err error
+		config, err = loadRuleConfig(rulesPath)
+		if err != nil {
+			return nil, err
+		}
+		source = rulesPath
+	}
+	return activateRules(config, source)
+
+}
+
+// Builds a new rule set from an already validated config and makes it the
+// active one, under the next version number
+func activateRules(config RuleConfig, source string) (*ruleSet, error) {
+
+	registry, err := config.registry()
+	if err != nil {
+		return nil, err
+	}
+	return activateRulesAfter(registry, source, nil)
+
+}
+
+/*
+Builds a new rule set from the registry under the next version number, and
+makes it the active one once prepare has succeeded with it. If prepare fails,
+the active rule set is left untouched and its error is returned. Other reloads
+wait until prepare is done. A nil prepare always succeeds.
+*/
+func activateRulesAfter(registry *RuleRegistry, source string, prepare func(set *ruleSet) error) (*ruleSet, error) {
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	latestRuleSetVersion++
+	next := &ruleSet{
+		version:  latestRuleSetVersion,
+		registry: registry,
+		source:   source,
+		loadedAt: time.Now(),
+	}
+	if prepare != nil {
+		if err := prepare(next); err != nil {
+			return nil, err
+		}
+	}
+	activeRules.Store(next)
+	return next, nil
+
+}
+
+// Reloads the rules every time the process receives a SIGHUP
+func reloadRulesOnSighup() {
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			if set, err := reloadRules(); err != nil {
+				fmt.Fprintf(os.Stderr, "Keeping scoring rules version %d, reload failed: %s\n", activeRules.Load().version, err)
+			} else {
+				fmt.Printf("Loaded scoring rules version %d from %s.\n", set.version, set.source)
+			}
+		}
+	}()
+
+}
+
+/*
+RuleSetResponse describes the active rule set, in response to GET requests to
+/admin/rules and POST requests to /admin/rules/reload.
+*/
+type RuleSetResponse struct {
+	Version  int             `json:"version"`
+	Source   string          `json:"source"`
+	LoadedAt time.Time       `json:"loadedAt"`
+	Rules    []RuleDescribed `json:"rules"`
+}
+
+type RuleDescribed struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func describeRuleSet(set *ruleSet) RuleSetResponse {
+
+	resp := RuleSetResponse{
+		Version:  set.version,
+		Source:   set.source,
+		LoadedAt: set.loadedAt,
+		Rules:    []RuleDescribed{},
+	}
+	for _, rule := range set.registry.Rules() {
+		resp.Rules = append(resp.Rules, RuleDescribed{
+			Name:        rule.Name(),
+			Description: rule.Description(),
+		})
+	}
+	return resp
+
+}
+
+// Handler for GET requests to /admin/rules
+func getRules(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(describeRuleSet(activeRules.Load()))
+
+}
+
+// Handler for POST requests to /admin/rules/reload
+func postReloadRules(w http.ResponseWriter, req *http.Request) {
+
+	set, err := reloadRules()
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "The scoring rules could not be reloaded: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(describeRuleSet(set))
+
+}
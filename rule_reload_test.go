@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Points rulesPath at a fresh config file containing config, restoring the
+// original rules once the test is over
+func useRuleConfigFile(t *testing.T, config string) string {
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	useRulesPath(t, path)
+	return path
+
+}
+
+// Points rulesPath at path, which is empty for the default rules, restoring
+// the original rules once the test is over
+func useRulesPath(t *testing.T, path string) {
+
+	oldPath, oldRules, oldVersion := rulesPath, activeRules.Load(), latestRuleSetVersion
+	t.Cleanup(func() {
+		rulesPath = oldPath
+		activeRules.Store(oldRules)
+		latestRuleSetVersion = oldVersion
+	})
+	rulesPath = path
+
+}
+
+// Fetches the breakdown for the receipt with the given ID
+func testGetBreakdownHelper(t *testing.T, id string) BreakdownResponse {
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/breakdown", nil)
+	w := httptest.NewRecorder()
+
+	getBreakdown(w, req)
+
+	data, _ := io.ReadAll(w.Result().Body)
+	var br BreakdownResponse
+	if err := json.Unmarshal(data, &br); err != nil {
+		t.Fatalf("Invalid JSON on GET: %s", err)
+	}
+	return br
+
+}
+
+func TestReloadRules(t *testing.T) {
+
+	path := useRuleConfigFile(t, `{"noCentsBonus": {"points": 100}}`)
+
+	payload := []byte(`{
+		"retailer": "a",
+		"purchaseDate": "2025-01-02",
+		"purchaseTime": "00:00",
+		"total": "1.00",
+		"items": [
+			{"shortDescription": "item", "price": "1.00"}
+		]
+	}`)
+
+	before := testGetBreakdownHelper(t, testPostHelper(t, payload))
+
+	// Reload through the admin endpoint
+	req := httptest.NewRequest(http.MethodPost, "/admin/rules/reload", nil)
+	w := httptest.NewRecorder()
+	postReloadRules(w, req)
+
+	var rs RuleSetResponse
+	data, _ := io.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &rs); err != nil {
+		t.Fatalf("Invalid JSON on reload: %s", err)
+	}
+	if rs.Version != before.RuleSetVersion+1 || rs.Source != path {
+		t.Errorf("Unexpected rule set after reload: %+v", rs)
+	}
+
+	// Receipts scored before the reload keep their points and version, while
+	// new receipts are scored by the new rules
+	after := testGetBreakdownHelper(t, testPostHelper(t, payload))
+	if before.Points != 1+50+25 || after.Points != 1+100+25 {
+		t.Errorf("Expected %v then %v but got %v then %v", 1+50+25, 1+100+25, before.Points, after.Points)
+	}
+	if after.RuleSetVersion != rs.Version {
+		t.Errorf("Expected version %v but got %v", rs.Version, after.RuleSetVersion)
+	}
+	if again := testGetBreakdownHelper(t, before.Id); again.Points != before.Points ||
+		again.RuleSetVersion != before.RuleSetVersion {
+		t.Errorf("Receipt scored before the reload was changed: %+v", again)
+	}
+
+}
+
+func TestFailedReloadKeepsRules(t *testing.T) {
+
+	useRuleConfigFile(t, `{"noCentsBonus": {"points": -1}}`)
+	active := activeRules.Load()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/rules/reload", nil)
+	w := httptest.NewRecorder()
+	postReloadRules(w, req)
+
+	if w.Result().StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("UnprocessableEntity header expected but not returned")
+	}
+	if activeRules.Load() != active {
+		t.Errorf("Active rules changed despite a failed reload")
+	}
+
+}
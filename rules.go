@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+/*
+ScoringRule unites the individual scoring rules from the spec. Apply is handed
+the score accumulated by the rules that ran before it as an int pointer, so a
+rule is free to add to it or to adjust the prior awards as a whole. It returns
+a human-readable explanation of why the rule awarded what it did.
+*/
+type ScoringRule interface {
+	Name() string
+	Description() string
+	Apply(r receipt, oldScore *int) string
+}
+
+/*
+RuleResult records one rule's contribution to a receipt's score, for
+reporting in the per-rule breakdown.
+*/
+type RuleResult struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+}
+
+/*
+RuleRegistry holds the ordered list of rules used to score a receipt. Rules are
+applied in the order in which they appear, and rule names must be unique so
+that individual rules can be removed or moved around by name.
+*/
+type RuleRegistry struct {
+	rules []ScoringRule
+}
+
+// Creates a registry containing the given rules, in the given order
+func NewRuleRegistry(rules ...ScoringRule) (*RuleRegistry, error) {
+
+	reg := &RuleRegistry{}
+	for _, rule := range rules {
+		if err := reg.Register(rule); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+
+}
+
+// Creates a registry containing the rules from the spec, in the spec's order
+func defaultRuleRegistry() *RuleRegistry {
+
+	reg, err := defaultRuleConfig().registry()
+	if err != nil {
+		panic(err)
+	}
+	return reg
+
+}
+
+// Appends a rule to the end of the registry. Fails if a rule with the same
+// name is already registered.
+func (reg *RuleRegistry) Register(rule ScoringRule) error {
+
+	if reg.index(rule.Name()) >= 0 {
+		return fmt.Errorf("a rule named %q is already registered", rule.Name())
+	}
+	reg.rules = append(reg.rules, rule)
+	return nil
+
+}
+
+// Removes the named rule from the registry. Returned bool indicates whether
+// the rule was present.
+func (reg *RuleRegistry) Remove(name string) bool {
+
+	i := reg.index(name)
+	if i < 0 {
+		return false
+	}
+	reg.rules = append(reg.rules[:i:i], reg.rules[i+1:]...)
+	return true
+
+}
+
+// Rearranges the registry so that its rules run in the order given. Every
+// registered rule must be named exactly once.
+func (reg *RuleRegistry) Reorder(names ...string) error {
+
+	if len(names) != len(reg.rules) {
+		return fmt.Errorf("expected %d rule names but got %d", len(reg.rules), len(names))
+	}
+
+	reordered := make([]ScoringRule, 0, len(names))
+	for _, name := range names {
+		i := reg.index(name)
+		if i < 0 {
+			return fmt.Errorf("no rule named %q is registered", name)
+		}
+		for _, rule := range reordered {
+			if rule.Name() == name {
+				return fmt.Errorf("rule %q named more than once", name)
+			}
+		}
+		reordered = append(reordered, reg.rules[i])
+	}
+	reg.rules = reordered
+	return nil
+
+}
+
+// Returns a copy of the registered rules, in the order they will be applied
+func (reg *RuleRegistry) Rules() []ScoringRule {
+	return append([]ScoringRule(nil), reg.rules...)
+}
+
+// Applies each registered rule in turn and returns the total score
+func (reg *RuleRegistry) Score(r receipt) int {
+
+	score, _ := reg.Breakdown(r)
+	return score
+
+}
+
+// Applies each registered rule in turn and returns the total score along with
+// the points each rule contributed to it
+func (reg *RuleRegistry) Breakdown(r receipt) (int, []RuleResult) {
+
+	score := 0
+	results := make([]RuleResult, 0, len(reg.rules))
+	for _, rule := range reg.rules {
+		before := score
+		reason := rule.Apply(r, &score)
+		results = append(results, RuleResult{
+			Rule:   rule.Name(),
+			Points: score - before,
+			Reason: reason,
+		})
+	}
+	return score, results
+
+}
+
+func (reg *RuleRegistry) index(name string) int {
+
+	for i, rule := range reg.rules {
+		if rule.Name() == name {
+			return i
+		}
+	}
+	return -1
+
+}
+
+// Implements this rule from the spec:
+//
+// One point for every alphanumeric character in the retailer name.
+type retailerNameRule struct {
+	pointsPerCharacter int
+}
+
+func (retailerNameRule) Name() string { return "retailerName" }
+
+func (rule retailerNameRule) Description() string {
+	return fmt.Sprintf("%d point(s) for every alphanumeric character in the retailer name.", rule.pointsPerCharacter)
+}
+
+func (rule retailerNameRule) Apply(r receipt, oldScore *int) string {
+	count := 0
+	for _, char := range r.retailer {
+		if unicode.IsLetter(char) || unicode.IsNumber(char) {
+			count += 1
+		}
+	}
+	*oldScore += count * rule.pointsPerCharacter
+	return fmt.Sprintf("%d alphanumeric characters in '%s'", count, r.retailer)
+}
+
+// Implements this rule from the spec:
+//
+// 50 points if the total is a round dollar amount with no cents.
+type noCentsBonusRule struct {
+	points int
+}
+
+func (noCentsBonusRule) Name() string { return "noCentsBonus" }
+
+func (rule noCentsBonusRule) Description() string {
+	return fmt.Sprintf("%d points if the total is a round dollar amount with no cents.", rule.points)
+}
+
+func (rule noCentsBonusRule) Apply(r receipt, oldScore *int) string {
+	if r.cents%100 == 0 {
+		*oldScore += rule.points
+		return fmt.Sprintf("total of %s is a round dollar amount", formatCents(r.cents))
+	}
+	return fmt.Sprintf("total of %s is not a round dollar amount", formatCents(r.cents))
+}
+
+// Implements this rule from the spec:
+//
+// 25 points if the total is a multiple of 0.25.
+type evenQuarterBonusRule struct {
+	multipleCents int
+	points        int
+}
+
+func (evenQuarterBonusRule) Name() string { return "evenQuarterBonus" }
+
+func (rule evenQuarterBonusRule) Description() string {
+	return fmt.Sprintf("%d points if the total is a multiple of %s.", rule.points, formatCents(rule.multipleCents))
+}
+
+func (rule evenQuarterBonusRule) Apply(r receipt, oldScore *int) string {
+	if r.cents%rule.multipleCents == 0 {
+		*oldScore += rule.points
+		return fmt.Sprintf("total of %s is a multiple of %s", formatCents(r.cents), formatCents(rule.multipleCents))
+	}
+	return fmt.Sprintf("total of %s is not a multiple of %s", formatCents(r.cents), formatCents(rule.multipleCents))
+}
+
+// Implements this rule from the spec:
+//
+// 5 points for every two items on the receipt.
+type numItemsRule struct {
+	itemsPerGroup  int
+	pointsPerGroup int
+}
+
+func (numItemsRule) Name() string { return "numItems" }
+
+func (rule numItemsRule) Description() string {
+	return fmt.Sprintf("%d points for every %d items on the receipt.", rule.pointsPerGroup, rule.itemsPerGroup)
+}
+
+func (rule numItemsRule) Apply(r receipt, oldScore *int) string {
+	groups := len(r.items) / rule.itemsPerGroup
+	*oldScore += groups * rule.pointsPerGroup
+	return fmt.Sprintf("%d groups of %d among %d items", groups, rule.itemsPerGroup, len(r.items))
+}
+
+// Implements this rule from the spec:
+//
+// If the trimmed length of the item description is a multiple of 3, multiply
+// the price by 0.2 and round up to the nearest integer. The result is the
+// number of points earned.
+type itemDescriptionLengthsRule struct {
+	lengthMultiple  int
+	priceMultiplier float64
+}
+
+func (itemDescriptionLengthsRule) Name() string { return "itemDescriptionLengths" }
+
+func (rule itemDescriptionLengthsRule) Description() string {
+	return fmt.Sprintf("If the trimmed length of the item description is a multiple of %d, "+
+		"multiply the price by %v and round up to the nearest integer.", rule.lengthMultiple, rule.priceMultiplier)
+}
+
+func (rule itemDescriptionLengthsRule) Apply(r receipt, oldScore *int) string {
+	// Prices are held in cents, so the multiplier is scaled down to match
+	centsMultiplier := rule.priceMultiplier / 100
+	var awards []string
+	for _, item := range r.items {
+		trimmed := strings.TrimSpace(item.shortDescription)
+		if len(trimmed)%rule.lengthMultiple == 0 {
+			points := int(math.Ceil(float64(item.cents) * centsMultiplier))
+			*oldScore += points
+			awards = append(awards, fmt.Sprintf("%d for '%s' priced at %s", points, trimmed, formatCents(item.cents)))
+		}
+	}
+	if len(awards) == 0 {
+		return fmt.Sprintf("no item descriptions have a trimmed length that is a multiple of %d", rule.lengthMultiple)
+	}
+	return strings.Join(awards, "; ")
+}
+
+// Implements this rule from the spec:
+//
+// 6 points if the day in the purchase date is odd.
+type oddPurchaseDatesRule struct {
+	points int
+}
+
+func (oddPurchaseDatesRule) Name() string { return "oddPurchaseDates" }
+
+func (rule oddPurchaseDatesRule) Description() string {
+	return fmt.Sprintf("%d points if the day in the purchase date is odd.", rule.points)
+}
+
+func (rule oddPurchaseDatesRule) Apply(r receipt, oldScore *int) string {
+	day := r.purchaseDatetime.Day()
+	if day%2 == 1 {
+		*oldScore += rule.points
+		return fmt.Sprintf("purchase day %d is odd", day)
+	}
+	return fmt.Sprintf("purchase day %d is even", day)
+}
+
+// Implements this rule from the spec:
+//
+// 10 points if the time of purchase is after 2:00pm and before 4:00pm.
+//
+// The window is exclusive at both ends and is measured in minutes past
+// midnight.
+type afternoonBonusRule struct {
+	startMinute int
+	endMinute   int
+	points      int
+}
+
+func (afternoonBonusRule) Name() string { return "afternoonBonus" }
+
+func (rule afternoonBonusRule) Description() string {
+	return fmt.Sprintf("%d points if the time of purchase is after %s and before %s.",
+		rule.points, formatMinute(rule.startMinute), formatMinute(rule.endMinute))
+}
+
+func (rule afternoonBonusRule) Apply(r receipt, oldScore *int) string {
+	purchaseTime := r.purchaseDatetime.Hour()*60 + r.purchaseDatetime.Minute()
+	if rule.startMinute < purchaseTime && purchaseTime < rule.endMinute {
+		*oldScore += rule.points
+		return fmt.Sprintf("purchased at %s, between %s and %s", formatMinute(purchaseTime),
+			formatMinute(rule.startMinute), formatMinute(rule.endMinute))
+	}
+	return fmt.Sprintf("purchased at %s, not between %s and %s", formatMinute(purchaseTime),
+		formatMinute(rule.startMinute), formatMinute(rule.endMinute))
+}
+
+// Formats an amount in cents the way the API writes prices, e.g. 265 as 2.65
+func formatCents(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// Formats a number of minutes past midnight as a 24-hour time, e.g. 840 as 14:00
+func formatMinute(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns the names of the registry's rules, in order
+func ruleNames(reg *RuleRegistry) []string {
+
+	var names []string
+	for _, rule := range reg.Rules() {
+		names = append(names, rule.Name())
+	}
+	return names
+
+}
+
+func sameNames(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+
+}
+
+func TestDefaultRuleOrder(t *testing.T) {
+
+	expected := []string{
+		"retailerName",
+		"noCentsBonus",
+		"evenQuarterBonus",
+		"numItems",
+		"itemDescriptionLengths",
+		"oddPurchaseDates",
+		"afternoonBonus",
+	}
+	if names := ruleNames(defaultRuleRegistry()); !sameNames(names, expected) {
+		t.Errorf("Expected %v but got %v", expected, names)
+	}
+
+}
+
+func TestRegisterDuplicateRule(t *testing.T) {
+
+	reg := defaultRuleRegistry()
+	if err := reg.Register(noCentsBonusRule{points: 50}); err == nil {
+		t.Errorf("Registering a duplicate rule should fail")
+	}
+
+}
+
+func TestRemoveRule(t *testing.T) {
+
+	r := receipt{
+		retailer:         "a",
+		purchaseDatetime: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+		items:            []item{{shortDescription: "item", cents: 100}},
+		cents:            100,
+	}
+
+	reg := defaultRuleRegistry()
+	if score := reg.Score(r); score != 1+50+25 {
+		t.Errorf("Expected %v but got %v", 1+50+25, score)
+	}
+
+	if !reg.Remove("noCentsBonus") {
+		t.Errorf("Removing a registered rule should succeed")
+	}
+	if reg.Remove("noCentsBonus") {
+		t.Errorf("Removing an unregistered rule should fail")
+	}
+	if score := reg.Score(r); score != 1+25 {
+		t.Errorf("Expected %v but got %v", 1+25, score)
+	}
+
+}
+
+func TestReorderRules(t *testing.T) {
+
+	reg, _ := NewRuleRegistry(oddPurchaseDatesRule{points: 6}, retailerNameRule{pointsPerCharacter: 1})
+
+	if err := reg.Reorder("retailerName", "oddPurchaseDates"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	expected := []string{"retailerName", "oddPurchaseDates"}
+	if names := ruleNames(reg); !sameNames(names, expected) {
+		t.Errorf("Expected %v but got %v", expected, names)
+	}
+
+	if err := reg.Reorder("retailerName"); err == nil {
+		t.Errorf("Reordering without naming every rule should fail")
+	}
+	if err := reg.Reorder("retailerName", "retailerName"); err == nil {
+		t.Errorf("Reordering with a repeated rule should fail")
+	}
+	if err := reg.Reorder("retailerName", "numItems"); err == nil {
+		t.Errorf("Reordering with an unregistered rule should fail")
+	}
+
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+ServerConfig holds the settings for the HTTP server itself. Each setting can
+come from a JSON config file (named with -config or RECEIPT_PROCESSOR_CONFIG),
+an environment variable, or a flag, and later sources override earlier ones:
+defaults, then the file, then the environment, then flags.
+
+Timeouts are written as Go durations, e.g. "30s" or "2m", and "0s" means no
+timeout. ShutdownTimeout is how long requests already in progress are given
+to finish once the server is told to stop. TLSCertFile and TLSKeyFile must be
+given together, and when they are the server speaks HTTPS.
+*/
+type ServerConfig struct {
+	Addr              string `json:"addr"`
+	TLSCertFile       string `json:"tlsCertFile"`
+	TLSKeyFile        string `json:"tlsKeyFile"`
+	ReadHeaderTimeout string `json:"readHeaderTimeout"`
+	ReadTimeout       string `json:"readTimeout"`
+	WriteTimeout      string `json:"writeTimeout"`
+	IdleTimeout       string `json:"idleTimeout"`
+	ShutdownTimeout   string `json:"shutdownTimeout"`
+}
+
+// Returns the configuration used when nothing else is given. The address is
+// the loopback one the server has always used, and the timeouts are generous
+// enough for a large batch upload while still cutting off clients that dribble
+// their requests in.
+func defaultServerConfig() ServerConfig {
+
+	return ServerConfig{
+		Addr:              "localhost:8080",
+		ReadHeaderTimeout: "5s",
+		ReadTimeout:       "1m",
+		WriteTimeout:      "1m",
+		IdleTimeout:       "2m",
+		ShutdownTimeout:   "30s",
+	}
+
+}
+
+// The flag and environment variable for each setting, along with where the
+// setting lives in a ServerConfig
+var serverSettings = []struct {
+	flag    string
+	env     string
+	usage   string
+	setting func(*ServerConfig) *string
+}{
+	{"addr", "RECEIPT_PROCESSOR_ADDR", "address to listen on, e.g. \":8080\" for every interface",
+		func(c *ServerConfig) *string { return &c.Addr }},
+	{"tls-cert", "RECEIPT_PROCESSOR_TLS_CERT", "path to a TLS certificate; serves HTTPS along with -tls-key",
+		func(c *ServerConfig) *string { return &c.TLSCertFile }},
+	{"tls-key", "RECEIPT_PROCESSOR_TLS_KEY", "path to the TLS certificate's private key",
+		func(c *ServerConfig) *string { return &c.TLSKeyFile }},
+	{"read-header-timeout", "RECEIPT_PROCESSOR_READ_HEADER_TIMEOUT", "time allowed to read a request's headers",
+		func(c *ServerConfig) *string { return &c.ReadHeaderTimeout }},
+	{"read-timeout", "RECEIPT_PROCESSOR_READ_TIMEOUT", "time allowed to read a whole request",
+		func(c *ServerConfig) *string { return &c.ReadTimeout }},
+	{"write-timeout", "RECEIPT_PROCESSOR_WRITE_TIMEOUT", "time allowed to write a response",
+		func(c *ServerConfig) *string { return &c.WriteTimeout }},
+	{"idle-timeout", "RECEIPT_PROCESSOR_IDLE_TIMEOUT", "time an idle keep-alive connection is held open",
+		func(c *ServerConfig) *string { return &c.IdleTimeout }},
+	{"shutdown-timeout", "RECEIPT_PROCESSOR_SHUTDOWN_TIMEOUT", "time in-flight requests are given to finish on SIGINT or SIGTERM",
+		func(c *ServerConfig) *string { return &c.ShutdownTimeout }},
+}
+
+// Adds a flag for each server setting, plus -config for the config file
+func addServerFlags(flags *flag.FlagSet) {
+
+	defaults := defaultServerConfig()
+	flags.String("config", "", "path to a JSON file configuring the server (env RECEIPT_PROCESSOR_CONFIG)")
+	for _, s := range serverSettings {
+		flags.String(s.flag, *s.setting(&defaults), fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+
+}
+
+/*
+Works out the server configuration from the defaults, the config file, the
+environment (read through getenv) and whichever of the flags added by
+addServerFlags were set on the command line, in that order.
+*/
+func loadServerConfig(flags *flag.FlagSet, getenv func(string) string) (ServerConfig, error) {
+
+	config := defaultServerConfig()
+
+	path := getenv("RECEIPT_PROCESSOR_CONFIG")
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			path = f.Value.String()
+		}
+	})
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return ServerConfig{}, fmt.Errorf("reading server config: %w", err)
+		}
+		if err := decodeConfig(data, &config); err != nil {
+			return ServerConfig{}, fmt.Errorf("server config %s: %w", path, err)
+		}
+	}
+
+	for _, s := range serverSettings {
+		if value := getenv(s.env); value != "" {
+			*s.setting(&config) = value
+		}
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range serverSettings {
+		if set[s.flag] {
+			*s.setting(&config) = flags.Lookup(s.flag).Value.String()
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return ServerConfig{}, err
+	}
+	return config, nil
+
+}
+
+// Checks the configuration for values the server couldn't start with. Every
+// problem found is reported, rather than just the first.
+func (c ServerConfig) validate() error {
+
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if c.Addr == "" {
+		problem("addr: must not be empty")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problem("tlsCertFile and tlsKeyFile must be given together")
+	}
+
+	timeouts := map[string]string{
+		"readHeaderTimeout": c.ReadHeaderTimeout,
+		"readTimeout":       c.ReadTimeout,
+		"writeTimeout":      c.WriteTimeout,
+		"idleTimeout":       c.IdleTimeout,
+		"shutdownTimeout":   c.ShutdownTimeout,
+	}
+	for _, name := range []string{"readHeaderTimeout", "readTimeout", "writeTimeout", "idleTimeout", "shutdownTimeout"} {
+		d, err := time.ParseDuration(timeouts[name])
+		if err != nil {
+			problem("%s: %q is not a duration such as \"30s\"", name, timeouts[name])
+		} else if d < 0 {
+			problem("%s: must not be negative", name)
+		}
+	}
+
+	return errors.Join(problems...)
+
+}
+
+// Whether the server should speak HTTPS
+func (c ServerConfig) usesTLS() bool {
+	return c.TLSCertFile != ""
+}
+
+// Builds an http.Server from a validated configuration
+func (c ServerConfig) server(handler http.Handler) *http.Server {
+
+	readHeaderTimeout, _ := time.ParseDuration(c.ReadHeaderTimeout)
+	readTimeout, _ := time.ParseDuration(c.ReadTimeout)
+	writeTimeout, _ := time.ParseDuration(c.WriteTimeout)
+	idleTimeout, _ := time.ParseDuration(c.IdleTimeout)
+
+	return &http.Server{
+		Addr:              c.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+}
+
+// How long a validated configuration gives in-flight requests to finish when
+// shutting down. Zero means waiting for as long as they take.
+func (c ServerConfig) shutdownTimeout() time.Duration {
+
+	timeout, _ := time.ParseDuration(c.ShutdownTimeout)
+	return timeout
+
+}
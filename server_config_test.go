@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parses the arguments with the server flags and loads the configuration,
+// taking environment variables from env
+func testServerConfigHelper(t *testing.T, args []string, env map[string]string) (ServerConfig, error) {
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	addServerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return loadServerConfig(flags, func(name string) string { return env[name] })
+
+}
+
+func TestServerConfigDefaults(t *testing.T) {
+
+	config, err := testServerConfigHelper(t, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if config != defaultServerConfig() || config.usesTLS() {
+		t.Errorf("Expected the defaults but got %+v", config)
+	}
+
+	server := config.server(nil)
+	if server.Addr != "localhost:8080" || server.ReadHeaderTimeout != 5*time.Second || server.IdleTimeout != 2*time.Minute {
+		t.Errorf("Server not built from the defaults: %+v", server)
+	}
+
+}
+
+func TestServerConfigPrecedence(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	file := `{"addr": ":9000", "readTimeout": "10s", "writeTimeout": "20s", "idleTimeout": "30s"}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := testServerConfigHelper(t,
+		[]string{"-config", path, "-write-timeout", "25s"},
+		map[string]string{
+			"RECEIPT_PROCESSOR_READ_TIMEOUT":  "15s",
+			"RECEIPT_PROCESSOR_WRITE_TIMEOUT": "22s",
+		})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// addr and idleTimeout come from the file, readTimeout from the
+	// environment, writeTimeout from the flag, and the rest are defaults
+	expected := defaultServerConfig()
+	expected.Addr = ":9000"
+	expected.ReadTimeout = "15s"
+	expected.WriteTimeout = "25s"
+	expected.IdleTimeout = "30s"
+	if config != expected {
+		t.Errorf("Expected %+v but got %+v", expected, config)
+	}
+
+	// The file can also be named in the environment
+	config, err = testServerConfigHelper(t, nil, map[string]string{"RECEIPT_PROCESSOR_CONFIG": path})
+	if err != nil || config.Addr != ":9000" {
+		t.Errorf("Expected :9000 from the file but got %q (error %v)", config.Addr, err)
+	}
+
+}
+
+func TestInvalidServerConfig(t *testing.T) {
+
+	_, err := testServerConfigHelper(t,
+		[]string{"-addr", "", "-tls-cert", "cert.pem", "-read-timeout", "soon", "-idle-timeout", "-1s"}, nil)
+	if err == nil {
+		t.Fatalf("Invalid settings should be rejected")
+	}
+	for _, expected := range []string{"addr", "tlsKeyFile", "readTimeout", "idleTimeout: must not be negative"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected a problem with %s in %q", expected, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	if err := os.WriteFile(path, []byte(`{"address": ":9000"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testServerConfigHelper(t, []string{"-config", path}, nil); err == nil ||
+		!strings.Contains(err.Error(), "address") {
+		t.Errorf("Expected an unknown field error but got %v", err)
+	}
+
+}
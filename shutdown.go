@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/*
+The exit statuses of the server:
+
+  - 0 once it has been stopped by a signal, every in-flight request has
+    finished, and the store has been closed
+  - 1 if it couldn't serve at all (e.g. the address was in use) or the store
+    couldn't be closed cleanly, so receipts may not have been written
+  - 3 if in-flight requests were still running when the shutdown timeout ran
+    out and had to be cut off. The store is still closed, so every receipt that
+    was acknowledged has been kept, but clients may not have got answers.
+*/
+const (
+	exitServerStopped = 0
+	exitServerFailed  = 1
+	exitDrainTimedOut = 3
+)
+
+// Returns a channel receiving the signals that should stop the server
+func notifyOnStop() <-chan os.Signal {
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	return stop
+
+}
+
+/*
+Runs serve, which should be one of server's Serve or ListenAndServe methods,
+until it fails or a signal arrives on stop. Once stopped, the server stops
+accepting connections and in-flight requests are given up to timeout (or as
+long as they need, if timeout is zero) to finish. Then stopWork, if not nil,
+is called to stop any background work using the store, and the store is
+closed. Returns the exit status (see above).
+*/
+func serveUntilStopped(server *http.Server, serve func() error, stop <-chan os.Signal, timeout time.Duration, stopWork func()) int {
+
+	served := make(chan error, 1)
+	go func() { served <- serve() }()
+
+	status := exitServerStopped
+	select {
+	case err := <-served:
+		fmt.Fprintln(os.Stderr, err)
+		status = exitServerFailed
+	case sig := <-stop:
+		fmt.Printf("Received %s, finishing in-flight requests.\n", sig)
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := server.Shutdown(ctx); errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "Requests still running after %s, closing their connections.\n", timeout)
+			server.Close()
+			status = exitDrainTimedOut
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = exitServerFailed
+		}
+	}
+
+	if stopWork != nil {
+		stopWork()
+	}
+	if err := store.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Closing the store: %s\n", err)
+		return exitServerFailed
+	}
+	if status == exitServerStopped {
+		fmt.Println("Server stopped.")
+	}
+	return status
+
+}
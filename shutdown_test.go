@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Starts a server on a free local port whose only handler waits until release
+// is closed. Returns the server's URL and a channel receiving the exit status.
+func testShutdownHelper(t *testing.T, stop chan os.Signal, release chan struct{}, timeout time.Duration) (string, chan int) {
+
+	useFreshStore(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		io.WriteString(w, "done")
+	})
+	server := &http.Server{Handler: mux}
+
+	status := make(chan int, 1)
+	go func() {
+		status <- serveUntilStopped(server, func() error { return server.Serve(listener) }, stop, timeout, nil)
+	}()
+	return "http://" + listener.Addr().String(), status
+
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+
+	stop := make(chan os.Signal, 1)
+	release := make(chan struct{})
+	url, status := testShutdownHelper(t, stop, release, 5*time.Second)
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		responses <- string(body)
+	}()
+
+	// Give the request time to arrive before stopping, then let it finish
+	time.Sleep(100 * time.Millisecond)
+	stop <- syscall.SIGTERM
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case s := <-status:
+		t.Fatalf("Server exited with %v before the request finished", s)
+	default:
+	}
+	close(release)
+
+	if body := <-responses; body != "done" {
+		t.Errorf("In-flight request not completed: %s", body)
+	}
+	if s := <-status; s != exitServerStopped {
+		t.Errorf("Expected exit status %v but got %v", exitServerStopped, s)
+	}
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Errorf("Server still accepting connections after shutdown")
+	}
+
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+
+	stop := make(chan os.Signal, 1)
+	release := make(chan struct{})
+	defer close(release)
+	url, status := testShutdownHelper(t, stop, release, 100*time.Millisecond)
+
+	go http.Get(url + "/slow")
+	time.Sleep(100 * time.Millisecond)
+	stop <- syscall.SIGINT
+
+	select {
+	case s := <-status:
+		if s != exitDrainTimedOut {
+			t.Errorf("Expected exit status %v but got %v", exitDrainTimedOut, s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server didn't give up on the request after the timeout")
+	}
+
+}
+
+func TestServeFailure(t *testing.T) {
+
+	useFreshStore(t)
+	server := &http.Server{Addr: "not an address"}
+	if s := serveUntilStopped(server, server.ListenAndServe, make(chan os.Signal), 0, nil); s != exitServerFailed {
+		t.Errorf("Expected exit status %v but got %v", exitServerFailed, s)
+	}
+
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ReceiptStore is implemented by everything that can hold on to scored
+receipts. The handlers only ever talk to the store through this interface, so
+the in-memory map and the on-disk log can be swapped for one another with the
+-store flag.
+
+Lookups of IDs that were never saved (or have been deleted) fail with
+errReceiptNotFound, as do lookups by idempotency key or content hash that
+match no stored receipt.
+
+Receipts submitted on behalf of an account are also indexed by account, and
+the store keeps each account's ledger (see ledger.go). Saving a receipt posts
+its points to its account's ledger, or the change in its points if it was
+already saved; deleting a receipt leaves the ledger alone. Voiding a receipt
+keeps it, with a record of the void, and posts a reversal of what is left of
+its points (see voids.go). A voided receipt can't be saved again or voided a
+second time; both fail with errReceiptVoided. An account exists from its
+first receipt onwards; lookups of any other account fail with
+errAccountNotFound.
+*/
+type ReceiptStore interface {
+	Save(id string, scored scoredReceipt) error
+	GetPoints(id string) (int, error)
+	Get(id string) (scoredReceipt, error)
+	List() ([]string, error)
+	Delete(id string) error
+	Void(id string, void ReceiptVoid) (LedgerEntry, error)
+	FindByIdempotencyKey(key string) (string, error)
+	FindByContentHash(hash string) (string, error)
+	GetBalance(accountId string) (balance int, version int, err error)
+	GetLedger(accountId string) ([]LedgerEntry, error)
+	PostEntry(accountId string, expectedVersion int, entry LedgerEntry) (LedgerEntry, error)
+	ListAccountReceipts(accountId string) ([]string, error)
+	ListAccounts() ([]string, error)
+	Close() error
+}
+
+var errReceiptNotFound = errors.New("receipt not found")
+var errAccountNotFound = errors.New("account not found")
+
+// The store used by the handlers. Defaults to memory, and is replaced in main
+// if the -store flag asks for something else.
+var store ReceiptStore = newMemoryStore()
+
+// Opens the store of the given kind, which is either "memory" or "file". The
+// path is only used by the file store.
+func openStore(kind string, path string) (ReceiptStore, error) {
+
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store %q, expected \"memory\" or \"file\"", kind)
+	}
+
+}
+
+/*
+memoryStore keeps receipts in maps, as receiptPoints used to. Everything it
+holds is lost when the process exits.
+
+Handlers run on concurrent goroutines, so the receipts are split across a
+fixed number of shards by a hash of their ID, each with its own lock. Requests
+for different receipts then rarely wait on one another.
+
+The idempotency key, content hash and account indexes map back to receipt IDs
+and sit behind a lock of their own, which is only ever taken while holding a
+shard's lock.
+*/
+type memoryStore struct {
+	shards [memoryStoreShards]memoryShard
+
+	indexMutex       sync.RWMutex
+	byIdempotencyKey map[string]string
+	byContentHash    map[string]string
+	byAccount        map[string]*accountIndex
+}
+
+// The receipts submitted on behalf of an account, with their purchase dates
+// and times, and its ledger
+type accountIndex struct {
+	receipts map[string]time.Time
+	entries  []LedgerEntry
+}
+
+// Returns the lots of points left in the account's ledger
+func (a *accountIndex) lots() []pointLot {
+
+	return remainingLots(a.entries, func(id string) (time.Time, bool) {
+		purchased, ok := a.receipts[id]
+		return purchased, ok
+	})
+
+}
+
+const memoryStoreShards = 32
+
+type memoryShard struct {
+	mutex    sync.RWMutex
+	receipts map[string]scoredReceipt
+}
+
+func newMemoryStore() *memoryStore {
+
+	s := &memoryStore{
+		byIdempotencyKey: make(map[string]string),
+		byContentHash:    make(map[string]string),
+		byAccount:        make(map[string]*accountIndex),
+	}
+	for i := range s.shards {
+		s.shards[i].receipts = make(map[string]scoredReceipt)
+	}
+	return s
+
+}
+
+// Returns the shard responsible for the given ID
+func (s *memoryStore) shard(id string) *memoryShard {
+
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return &s.shards[hash.Sum32()%memoryStoreShards]
+
+}
+
+func (s *memoryStore) Save(id string, scored scoredReceipt) error {
+	return s.save(id, scored, time.Now())
+}
+
+// Saves a receipt as of the given time, which is recorded against the ledger
+// entry posted for it
+func (s *memoryStore) save(id string, scored scoredReceipt, at time.Time) error {
+
+	shard := s.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	old, present := shard.receipts[id]
+	if present && old.void != nil {
+		return errReceiptVoided
+	}
+	if present {
+		s.unindex(id, old)
+	}
+	shard.receipts[id] = scored
+	s.index(id, scored)
+
+	if scored.accountId == "" {
+		return nil
+	}
+	_, err := s.post(scored.accountId, anyVersion, func(account *accountIndex) (LedgerEntry, bool) {
+		credited, found := receiptCredited(account.entries, id)
+		if !found {
+			return LedgerEntry{Kind: entryCredit, Points: scored.points, ReceiptId: id, CreatedAt: at}, true
+		}
+
+		// The adjustment is worked out from what the ledger holds for the
+		// receipt, not its old points, as a rescore can only take back the
+		// points that haven't been spent or expired
+		change := scored.points - credited
+		if change < 0 {
+			change = max(change, -receiptPointsLeft(account.lots(), id))
+		}
+		if change == 0 {
+			return LedgerEntry{}, false
+		}
+		return LedgerEntry{Kind: entryAdjustment, Points: change, ReceiptId: id, CreatedAt: at}, true
+	})
+	return err
+
+}
+
+func (s *memoryStore) GetPoints(id string) (int, error) {
+
+	scored, err := s.Get(id)
+	return scored.points, err
+
+}
+
+func (s *memoryStore) Get(id string) (scoredReceipt, error) {
+
+	shard := s.shard(id)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	scored, present := shard.receipts[id]
+	if !present {
+		return scoredReceipt{}, errReceiptNotFound
+	}
+	return scored, nil
+
+}
+
+// Returns the IDs of every stored receipt, sorted so that the order is stable.
+// Shards are visited one at a time, so receipts saved while the list is being
+// built may or may not be included.
+func (s *memoryStore) List() ([]string, error) {
+
+	var ids []string
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.RLock()
+		for id := range shard.receipts {
+			ids = append(ids, id)
+		}
+		shard.mutex.RUnlock()
+	}
+	sort.Strings(ids)
+	return ids, nil
+
+}
+
+func (s *memoryStore) Delete(id string) error {
+
+	shard := s.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	old, present := shard.receipts[id]
+	if !present {
+		return errReceiptNotFound
+	}
+	delete(shard.receipts, id)
+	s.unindex(id, old)
+	return nil
+
+}
+
+// Marks a receipt voided and posts the reversal of its points. The returned
+// entry is the reversal, or the zero entry if the receipt has no account.
+func (s *memoryStore) Void(id string, void ReceiptVoid) (LedgerEntry, error) {
+
+	shard := s.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	scored, present := shard.receipts[id]
+	if !present {
+		return LedgerEntry{}, errReceiptNotFound
+	}
+	if scored.void != nil {
+		return LedgerEntry{}, errReceiptVoided
+	}
+	scored.void = &void
+	shard.receipts[id] = scored
+
+	if scored.accountId == "" {
+		return LedgerEntry{}, nil
+	}
+	// Points of the receipt's that have been spent or have expired are gone
+	// already, so only what is left of them is reversed
+	return s.post(scored.accountId, anyVersion, func(account *accountIndex) (LedgerEntry, bool) {
+		return LedgerEntry{
+			Kind:        entryReversal,
+			Points:      -receiptPointsLeft(account.lots(), id),
+			ReceiptId:   id,
+			Description: void.Reason,
+			CreatedAt:   void.VoidedAt,
+		}, true
+	})
+
+}
+
+func (s *memoryStore) FindByIdempotencyKey(key string) (string, error) {
+
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+
+	id, present := s.byIdempotencyKey[key]
+	if !present {
+		return "", errReceiptNotFound
+	}
+	return id, nil
+
+}
+
+func (s *memoryStore) FindByContentHash(hash string) (string, error) {
+
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+
+	id, present := s.byContentHash[hash]
+	if !present {
+		return "", errReceiptNotFound
+	}
+	return id, nil
+
+}
+
+func (s *memoryStore) GetBalance(accountId string) (int, int, error) {
+
+	entries, err := s.GetLedger(accountId)
+	if err != nil || len(entries) == 0 {
+		return 0, 0, err
+	}
+	last := entries[len(entries)-1]
+	return last.Balance, last.Sequence, nil
+
+}
+
+func (s *memoryStore) GetLedger(accountId string) ([]LedgerEntry, error) {
+
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+
+	account, present := s.byAccount[accountId]
+	if !present {
+		return nil, errAccountNotFound
+	}
+	// Entries are never changed once appended, so sharing them is safe as
+	// long as the caller can't append to the same array
+	return account.entries[:len(account.entries):len(account.entries)], nil
+
+}
+
+func (s *memoryStore) PostEntry(accountId string, expectedVersion int, entry LedgerEntry) (LedgerEntry, error) {
+
+	return s.post(accountId, expectedVersion, func(*accountIndex) (LedgerEntry, bool) {
+		return entry, true
+	})
+
+}
+
+/*
+Posts the entry that build works out from the account as it stands, holding
+the index lock throughout so that nothing can be posted in between. build
+returns false if there is nothing to post, in which case the zero entry is
+returned.
+*/
+func (s *memoryStore) post(accountId string, expectedVersion int, build func(account *accountIndex) (LedgerEntry, bool)) (LedgerEntry, error) {
+
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+
+	account, present := s.byAccount[accountId]
+	if !present {
+		return LedgerEntry{}, errAccountNotFound
+	}
+	entry, ok := build(account)
+	if !ok {
+		return LedgerEntry{}, nil
+	}
+	entry, err := nextLedgerEntry(account.entries, expectedVersion, entry)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	account.entries = append(account.entries, entry)
+	return entry, nil
+
+}
+
+// Works out the entry PostEntry would append, without appending it
+func (s *memoryStore) prepareEntry(accountId string, expectedVersion int, entry LedgerEntry) (LedgerEntry, error) {
+
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+
+	account, present := s.byAccount[accountId]
+	if !present {
+		return LedgerEntry{}, errAccountNotFound
+	}
+	return nextLedgerEntry(account.entries, expectedVersion, entry)
+
+}
+
+// Returns the IDs of the account's receipts, sorted so that the order is
+// stable
+func (s *memoryStore) ListAccountReceipts(accountId string) ([]string, error) {
+
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+
+	account, present := s.byAccount[accountId]
+	if !present {
+		return nil, errAccountNotFound
+	}
+	ids := make([]string, 0, len(account.receipts))
+	for id := range account.receipts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+
+}
+
+// Returns the IDs of every account, sorted so that the order is stable
+func (s *memoryStore) ListAccounts() ([]string, error) {
+
+	s.indexMutex.RLock()
+	defer s.indexMutex.RUnlock()
+
+	ids := make([]string, 0, len(s.byAccount))
+	for id := range s.byAccount {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+
+}
+
+// Adds a receipt to the indexes. The first receipt saved with a given content
+// hash stays the one the hash points to.
+func (s *memoryStore) index(id string, scored scoredReceipt) {
+
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+
+	if scored.idempotencyKey != "" {
+		s.byIdempotencyKey[scored.idempotencyKey] = id
+	}
+	if _, present := s.byContentHash[scored.contentHash]; !present && scored.contentHash != "" {
+		s.byContentHash[scored.contentHash] = id
+	}
+	if scored.accountId != "" {
+		account, present := s.byAccount[scored.accountId]
+		if !present {
+			account = &accountIndex{receipts: make(map[string]time.Time)}
+			s.byAccount[scored.accountId] = account
+		}
+		account.receipts[id] = scored.receipt.purchaseDatetime
+	}
+
+}
+
+// Removes a receipt from the indexes. Its account, and the account's ledger,
+// are kept.
+func (s *memoryStore) unindex(id string, scored scoredReceipt) {
+
+	s.indexMutex.Lock()
+	defer s.indexMutex.Unlock()
+
+	if s.byIdempotencyKey[scored.idempotencyKey] == id {
+		delete(s.byIdempotencyKey, scored.idempotencyKey)
+	}
+	if s.byContentHash[scored.contentHash] == id {
+		delete(s.byContentHash, scored.contentHash)
+	}
+	if account, present := s.byAccount[scored.accountId]; present {
+		delete(account.receipts, id)
+	}
+
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
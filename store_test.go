@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Swaps in an empty memory store for the duration of a test, so that the test
+// only sees the receipts it submits itself
+func useFreshStore(t *testing.T) {
+
+	old := store
+	t.Cleanup(func() { store = old })
+	store = newMemoryStore()
+
+}
+
+// Checks the behaviour every ReceiptStore must share
+func testStoreContractHelper(t *testing.T, s ReceiptStore) {
+
+	scored := scoredReceipt{
+		receipt: receipt{
+			retailer:         "M&M Corner Market",
+			purchaseDatetime: time.Date(2022, 3, 20, 14, 33, 0, 0, time.UTC),
+			items:            []item{{shortDescription: "Gatorade", cents: 225}},
+			cents:            225,
+		},
+		points:         109,
+		breakdown:      []RuleResult{{Rule: "retailerName", Points: 109, Reason: "test"}},
+		ruleSetVersion: 3,
+		idempotencyKey: "key-b",
+		contentHash:    "hash-b",
+		accountId:      "account-b",
+	}
+
+	if _, err := s.Get("missing"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("Expected errReceiptNotFound but got %v", err)
+	}
+
+	if err := s.Save("b", scored); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := s.Save("a", scoredReceipt{points: 5, contentHash: "hash-a"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if points, err := s.GetPoints("b"); err != nil || points != 109 {
+		t.Errorf("Expected 109 points but got %v (error %v)", points, err)
+	}
+	got, err := s.Get("b")
+	if err != nil || got.ruleSetVersion != 3 || len(got.breakdown) != 1 ||
+		got.receipt.toRaw().Retailer != "M&M Corner Market" || len(got.receipt.items) != 1 {
+		t.Errorf("Stored receipt not returned intact: %+v (error %v)", got, err)
+	}
+
+	if id, err := s.FindByIdempotencyKey("key-b"); err != nil || id != "b" {
+		t.Errorf("Expected b by idempotency key but got %v (error %v)", id, err)
+	}
+	if id, err := s.FindByContentHash("hash-b"); err != nil || id != "b" {
+		t.Errorf("Expected b by content hash but got %v (error %v)", id, err)
+	}
+	if _, err := s.FindByIdempotencyKey("key-x"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("Expected errReceiptNotFound but got %v", err)
+	}
+
+	ids, err := s.List()
+	if err != nil || len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("Expected [a b] but got %v (error %v)", ids, err)
+	}
+
+	if balance, _, err := s.GetBalance("account-b"); err != nil || balance != 109 {
+		t.Errorf("Expected a balance of 109 but got %v (error %v)", balance, err)
+	}
+	if ids, err := s.ListAccountReceipts("account-b"); err != nil || len(ids) != 1 || ids[0] != "b" {
+		t.Errorf("Expected [b] for the account but got %v (error %v)", ids, err)
+	}
+	if _, _, err := s.GetBalance("account-x"); !errors.Is(err, errAccountNotFound) {
+		t.Errorf("Expected errAccountNotFound but got %v", err)
+	}
+
+	// Saving a receipt again replaces its points in the balance
+	scored.points = 100
+	if err := s.Save("b", scored); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if balance, _, _ := s.GetBalance("account-b"); balance != 100 {
+		t.Errorf("Expected a balance of 100 after saving again but got %v", balance)
+	}
+
+	// Redemptions are checked against the version and the balance
+	redemption := LedgerEntry{Kind: entryRedemption, Points: -40, Description: "test"}
+	if _, err := s.PostEntry("account-b", 1, redemption); !errors.Is(err, errVersionConflict) {
+		t.Errorf("Expected errVersionConflict but got %v", err)
+	}
+	if _, err := s.PostEntry("account-b", 2, LedgerEntry{Kind: entryRedemption, Points: -101}); !errors.Is(err, errInsufficientPoints) {
+		t.Errorf("Expected errInsufficientPoints but got %v", err)
+	}
+	if entry, err := s.PostEntry("account-b", 2, redemption); err != nil || entry.Sequence != 3 || entry.Balance != 60 {
+		t.Errorf("Unexpected redemption entry %+v (error %v)", entry, err)
+	}
+	if _, err := s.PostEntry("account-x", anyVersion, redemption); !errors.Is(err, errAccountNotFound) {
+		t.Errorf("Expected errAccountNotFound but got %v", err)
+	}
+
+	// The credit, the adjustment from saving again, and the redemption
+	entries, err := s.GetLedger("account-b")
+	if err != nil || len(entries) != 3 || entries[0].Kind != entryCredit || entries[0].Points != 109 ||
+		entries[1].Kind != entryAdjustment || entries[1].Points != -9 || entries[2].Points != -40 {
+		t.Errorf("Unexpected ledger %+v (error %v)", entries, err)
+	}
+
+	// Voiding reverses what the account has left of the receipt's points
+	void := ReceiptVoid{Reason: "returned", VoidedBy: "clerk", VoidedAt: time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)}
+	if entry, err := s.Void("b", void); err != nil || entry.Kind != entryReversal || entry.Points != -60 ||
+		entry.Balance != 0 || entry.ReceiptId != "b" {
+		t.Errorf("Unexpected reversal entry %+v (error %v)", entry, err)
+	}
+	if _, err := s.Void("b", void); !errors.Is(err, errReceiptVoided) {
+		t.Errorf("Expected errReceiptVoided voiding twice but got %v", err)
+	}
+	if err := s.Save("b", scored); !errors.Is(err, errReceiptVoided) {
+		t.Errorf("Expected errReceiptVoided saving a voided receipt but got %v", err)
+	}
+	if _, err := s.Void("missing", void); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("Expected errReceiptNotFound but got %v", err)
+	}
+	if entry, err := s.Void("a", void); err != nil || entry != (LedgerEntry{}) {
+		t.Errorf("Expected no reversal for a receipt without an account but got %+v (error %v)", entry, err)
+	}
+	if got, _ := s.Get("b"); got.void == nil || *got.void != void || got.points != 100 {
+		t.Errorf("Voided receipt not kept with its void: %+v", got)
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := s.Delete("a"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("Expected errReceiptNotFound but got %v", err)
+	}
+	if _, err := s.GetPoints("a"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("Expected errReceiptNotFound but got %v", err)
+	}
+	if _, err := s.FindByContentHash("hash-a"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("Deleted receipt still found by content hash: %v", err)
+	}
+
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreContractHelper(t, newMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "receipts.log")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	testStoreContractHelper(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Everything written before closing should be back after reopening
+	s, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+
+	ids, _ := s.List()
+	if len(ids) != 1 || ids[0] != "b" {
+		t.Errorf("Expected [b] after reopening but got %v", ids)
+	}
+	if id, _ := s.FindByIdempotencyKey("key-b"); id != "b" {
+		t.Errorf("Expected b by idempotency key after reopening but got %v", id)
+	}
+	got, _ := s.Get("b")
+	if got.points != 100 {
+		t.Errorf("Expected 100 points after reopening but got %v", got.points)
+	}
+	if balance, version, _ := s.GetBalance("account-b"); balance != 0 || version != 4 {
+		t.Errorf("Expected a balance of 0 at version 4 after reopening but got %v at %v", balance, version)
+	}
+	if got.void == nil || got.void.Reason != "returned" || got.void.VoidedBy != "clerk" {
+		t.Errorf("Expected the void to be kept after reopening but got %+v", got.void)
+	}
+	if entries, _ := s.GetLedger("account-b"); len(entries) != 4 || entries[0].CreatedAt.IsZero() ||
+		entries[2].Description != "test" || entries[3].Kind != entryReversal {
+		t.Errorf("Ledger not restored intact after reopening: %+v", entries)
+	}
+	raw := got.receipt.toRaw()
+	if raw.PurchaseDate != "2022-03-20" || raw.PurchaseTime != "14:33" || raw.Total != "2.25" ||
+		raw.Items[0] != (RawItem{ShortDescription: "Gatorade", Price: "2.25"}) {
+		t.Errorf("Receipt not restored intact after reopening: %+v", raw)
+	}
+
+}
+
+// Checks that rescoring a receipt whose points have been spent never credits
+// the account more than the receipt is worth
+func testRescoreAfterRedemptionHelper(t *testing.T, s ReceiptStore) {
+
+	scored := scoredReceipt{points: 100, accountId: "card-1"}
+	rescore := func(points int) {
+		scored.points = points
+		if err := s.Save("r", scored); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	rescore(100)
+	if _, err := s.PostEntry("card-1", anyVersion, LedgerEntry{Kind: entryRedemption, Points: -100}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The points have all been spent, so lowering them takes nothing back and
+	// raising them again gives nothing back
+	rescore(0)
+	rescore(100)
+	if balance, version, _ := s.GetBalance("card-1"); balance != 0 || version != 2 {
+		t.Errorf("Expected a balance of 0 at version 2 but got %v at %v", balance, version)
+	}
+
+	// Only the points beyond what was credited are new
+	rescore(120)
+	if balance, _, _ := s.GetBalance("card-1"); balance != 20 {
+		t.Errorf("Expected a balance of 20 but got %v", balance)
+	}
+
+}
+
+func TestRescoreAfterRedemption(t *testing.T) {
+
+	testRescoreAfterRedemptionHelper(t, newMemoryStore())
+
+	// The file store should arrive at the same ledger when replaying its log
+	path := filepath.Join(t.TempDir(), "receipts.log")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	testRescoreAfterRedemptionHelper(t, s)
+	s.Close()
+	s, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	if balance, version, _ := s.GetBalance("card-1"); balance != 20 || version != 3 {
+		t.Errorf("Expected a balance of 20 at version 3 after reopening but got %v at %v", balance, version)
+	}
+
+}
+
+func TestFileStoreDropsPartialLine(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "receipts.log")
+	log := `{"op":"save","id":"a","record":{"points":5,"breakdown":null,"ruleSetVersion":1}}` + "\n" +
+		`{"op":"save","id":"b","rec`
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := s.Save("c", scoredReceipt{points: 7}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s.Close()
+
+	// The partial line should have been replaced by the new entry
+	s, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	if ids, _ := s.List(); len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Errorf("Expected [a c] but got %v", ids)
+	}
+
+}
+
+func TestOpenUnknownStore(t *testing.T) {
+	if _, err := openStore("bolt", ""); err == nil {
+		t.Errorf("Opening an unknown kind of store should fail")
+	}
+}
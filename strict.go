@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+Whether receipts are checked strictly by default. Set with the -strict-json
+flag. A client can ask for strict checking of a single request with a
+Strict-JSON header of "true", but can't turn it off: when the operator has
+turned strict mode on, "false" is ignored, since the checks guard against
+receipts crafted to slip past validation (e.g. a second total that wins over
+the first).
+
+In strict mode, on top of the usual validation, a receipt is rejected if its
+JSON has a field the API doesn't define, the same key twice in one object
+(json.Unmarshal would silently keep the last value), a field missing
+altogether, or a null where a value belongs. Each is reported with its own
+code and a JSON pointer to the offending key.
+*/
+var strictJSON bool
+
+// Adds the flag setting strictJSON
+func addStrictFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&strictJSON, "strict-json", false, "reject receipts with unknown fields, duplicate keys, missing fields or nulls")
+}
+
+// Works out whether a request is checked strictly, which it is if either the
+// server or the request asks for it. The returned bool is false, and the
+// client has been sent a 400, if the header is unreadable.
+func requestStrictness(w http.ResponseWriter, req *http.Request) (bool, bool) {
+
+	header := req.Header.Get("Strict-JSON")
+	if header == "" {
+		return strictJSON, true
+	}
+	strict, err := strconv.ParseBool(header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The Strict-JSON header must be true or false.")
+		return false, false
+	}
+	return strict || strictJSON, true
+
+}
+
+// Escapes a key for use as one step of a JSON pointer (RFC 6901)
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+/*
+Checks well-formed JSON against the shape of RawReceipt, as declared by its
+json tags, and returns the problems strict mode cares about. Values of the
+wrong type are left alone, since unmarshalling reports those.
+*/
+func strictProblems(data []byte) []ValidationError {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var problems []ValidationError
+	checkStrictValue(decoder, reflect.TypeOf(RawReceipt{}), "", &problems)
+	return problems
+
+}
+
+// Checks the next value in the decoder against the Go type it will be
+// unmarshalled into, appending problems as they're found
+func checkStrictValue(decoder *json.Decoder, t reflect.Type, path string, problems *[]ValidationError) {
+
+	token, err := decoder.Token()
+	if err != nil {
+		return
+	}
+
+	if token == nil {
+		*problems = append(*problems, ValidationError{
+			Path:    path,
+			Code:    "invalid_type",
+			Message: fmt.Sprintf("expected JSON %s but got JSON null", jsonTypeName(t.Kind().String())),
+		})
+		return
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && token == json.Delim('{'):
+		checkStrictObject(decoder, t, path, problems)
+	case t.Kind() == reflect.Slice && token == json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			checkStrictValue(decoder, t.Elem(), fmt.Sprintf("%s/%d", path, i), problems)
+		}
+		decoder.Token()
+	default:
+		skipValue(decoder, token)
+	}
+
+}
+
+// Checks the keys of an object whose opening brace has just been read
+func checkStrictObject(decoder *json.Decoder, t reflect.Type, path string, problems *[]ValidationError) {
+
+	fields := make(map[string]reflect.Type)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = t.Field(i).Type
+		names = append(names, name)
+	}
+
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		key := token.(string)
+		keyPath := path + "/" + pointerEscaper.Replace(key)
+
+		fieldType, known := fields[key]
+		switch {
+		case !known:
+			*problems = append(*problems, ValidationError{
+				Path:    keyPath,
+				Code:    "unknown_field",
+				Message: fmt.Sprintf("%q is not a field the API defines", key),
+			})
+			skipValue(decoder, nil)
+		case seen[key]:
+			*problems = append(*problems, ValidationError{
+				Path:    keyPath,
+				Code:    "duplicate_key",
+				Message: fmt.Sprintf("%s is given more than once", key),
+			})
+			skipValue(decoder, nil)
+		default:
+			checkStrictValue(decoder, fieldType, keyPath, problems)
+		}
+		seen[key] = true
+	}
+	decoder.Token()
+
+	for _, name := range names {
+		if !seen[name] {
+			*problems = append(*problems, ValidationError{
+				Path:    path + "/" + name,
+				Code:    "missing_field",
+				Message: fmt.Sprintf("%s is missing", name),
+			})
+		}
+	}
+
+}
+
+// Consumes the rest of a value whose first token has already been read, or
+// the whole of the next value if token is nil
+func skipValue(decoder *json.Decoder, token json.Token) {
+
+	if token == nil {
+		var err error
+		if token, err = decoder.Token(); err != nil {
+			return
+		}
+	}
+	if token != json.Delim('{') && token != json.Delim('[') {
+		return
+	}
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+
+}
+
+// Combines the problems found in strict mode with those from validation,
+// leaving out validation's vaguer report of a field already reported as
+// missing or null
+func mergeStrictProblems(strict []ValidationError, validation []ValidationError) []ValidationError {
+
+	reported := make(map[string]bool)
+	for _, problem := range strict {
+		reported[problem.Path] = true
+	}
+	problems := strict
+	for _, problem := range validation {
+		if !reported[problem.Path] {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Posts the payload with the given Strict-JSON header (if not empty) and
+// returns the recorded response
+func testStrictPostHelper(t *testing.T, payload string, header string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(payload))
+	if header != "" {
+		req.Header.Set("Strict-JSON", header)
+	}
+	w := httptest.NewRecorder()
+	processReceipt(w, req)
+	return w
+
+}
+
+// Posts the payload in strict mode, expecting it to be rejected, and returns
+// the problems reported
+func testStrictProblemsHelper(t *testing.T, payload string) []ValidationError {
+
+	w := testStrictPostHelper(t, payload, "true")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected BadRequest but got %v: %s", w.Code, w.Body)
+	}
+	var er ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+		t.Fatalf("Invalid JSON in error response: %s", err)
+	}
+	return er.Errors
+
+}
+
+func TestStrictDuplicateKey(t *testing.T) {
+
+	useFreshStore(t)
+
+	// The second total would be the one scored, earning the round dollar and
+	// quarter bonuses
+	payload := `{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25",
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}], "total": "100.00"}`
+
+	if w := testStrictPostHelper(t, payload, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected OK outside strict mode but got %v", w.Code)
+	}
+	problems := testStrictProblemsHelper(t, payload)
+	expectProblems(t, problems, ValidationError{Path: "/total", Code: "duplicate_key"})
+
+}
+
+func TestStrictUnknownFields(t *testing.T) {
+
+	payload := `{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25",
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25", "qty": {"n": [1, 2]}}], "foo/bar": 13.37}`
+
+	problems := testStrictProblemsHelper(t, payload)
+	expectProblems(t, problems,
+		ValidationError{Path: "/items/0/qty", Code: "unknown_field"},
+		ValidationError{Path: "/foo~1bar", Code: "unknown_field"})
+
+}
+
+func TestStrictMissingAndNullFields(t *testing.T) {
+
+	payload := `{"retailer": null, "purchaseDate": "2022-01-02", "purchaseTime": "13:13",
+		"items": [{"shortDescription": "Pepsi<"}]}`
+
+	// The missing and null fields are reported once each, alongside the
+	// usual validation problems
+	problems := testStrictProblemsHelper(t, payload)
+	expectProblems(t, problems,
+		ValidationError{Path: "/retailer", Code: "invalid_type"},
+		ValidationError{Path: "/items/0/price", Code: "missing_field"},
+		ValidationError{Path: "/total", Code: "missing_field"},
+		ValidationError{Path: "/items/0/shortDescription", Code: "invalid_characters"})
+
+}
+
+func TestStrictWrongType(t *testing.T) {
+
+	payload := `{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": 1.25,
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}], "extra": true}`
+
+	problems := testStrictProblemsHelper(t, payload)
+	expectProblems(t, problems,
+		ValidationError{Path: "/extra", Code: "unknown_field"},
+		ValidationError{Path: "/total", Code: "invalid_type"})
+
+}
+
+func TestStrictHeader(t *testing.T) {
+
+	useFreshStore(t)
+	strictJSON = true
+	t.Cleanup(func() { strictJSON = false })
+
+	payload := `{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "1.25",
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}], "foo": 1}`
+
+	if w := testStrictPostHelper(t, payload, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected BadRequest with strict mode on by default but got %v", w.Code)
+	}
+	if w := testStrictPostHelper(t, payload, "false"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the header not to turn strict mode off but got %v", w.Code)
+	}
+	if w := testStrictPostHelper(t, payload, "sometimes"); w.Code != http.StatusBadRequest ||
+		!strings.Contains(w.Body.String(), "Strict-JSON") {
+		t.Errorf("Expected the bad header to be reported but got %v: %s", w.Code, w.Body)
+	}
+
+	// With strict mode off by default, the header decides
+	strictJSON = false
+	if w := testStrictPostHelper(t, payload, "true"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected BadRequest with strict mode turned on by the header but got %v", w.Code)
+	}
+	if w := testStrictPostHelper(t, payload, "false"); w.Code != http.StatusOK {
+		t.Errorf("Expected OK with strict mode off but got %v", w.Code)
+	}
+
+}
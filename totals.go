@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+The policies for a receipt whose total doesn't match the sum of its item
+prices, chosen with the -total-policy flag:
+
+  - warn: the receipt is accepted, but the discrepancy is reported alongside
+    its score and breakdown
+  - tolerance: the receipt is rejected if the difference is more than
+    -total-tolerance, which is either an amount (e.g. "2.00") or a percentage
+    of the items' sum (e.g. "15%"), to allow for tax and tips. Smaller
+    differences are reported as with warn.
+  - strict: the receipt is rejected unless the total matches exactly
+
+Without a check, a receipt can claim a round total to earn the no-cents and
+quarter bonuses whatever its items cost.
+*/
+const (
+	totalPolicyWarn      = "warn"
+	totalPolicyTolerance = "tolerance"
+	totalPolicyStrict    = "strict"
+)
+
+// The policy and tolerance applied to newly submitted receipts
+var totalPolicy = totalPolicyWarn
+var totalTolerance = "0.00"
+
+// Checks that a policy and tolerance named on the command line make sense
+func validateTotalPolicy(policy string, tolerance string) error {
+
+	switch policy {
+	case totalPolicyWarn, totalPolicyTolerance, totalPolicyStrict:
+	default:
+		return fmt.Errorf("unknown total policy %q, expected %q, %q or %q",
+			policy, totalPolicyWarn, totalPolicyTolerance, totalPolicyStrict)
+	}
+	if _, _, err := parseTolerance(tolerance); err != nil {
+		return err
+	}
+	return nil
+
+}
+
+// Parses a tolerance written either as an amount like "2.00" or as a
+// percentage like "15%". Exactly one of the returned values is meaningful,
+// and the other is zero.
+func parseTolerance(tolerance string) (int, float64, error) {
+
+	if percent, ok := strings.CutSuffix(tolerance, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value < 0 {
+			return 0, 0, fmt.Errorf("total tolerance %q must be a non-negative percentage like \"15%%\"", tolerance)
+		}
+		return 0, value, nil
+	}
+	cents, ok := parseCents(tolerance)
+	if !ok {
+		return 0, 0, fmt.Errorf("total tolerance %q must be an amount like \"2.00\" or a percentage like \"15%%\"", tolerance)
+	}
+	return cents, 0, nil
+
+}
+
+// Returns the sum of the receipt's item prices, in cents
+func (r receipt) itemsCents() int {
+
+	sum := 0
+	for _, item := range r.items {
+		sum += item.cents
+	}
+	return sum
+
+}
+
+// Checks a receipt's total against its items under the current policy,
+// returning a problem describing the difference if it's too great
+func checkTotal(r receipt) (ValidationError, bool) {
+
+	itemsCents := r.itemsCents()
+	difference := r.cents - itemsCents
+	if difference < 0 {
+		difference = -difference
+	}
+
+	allowed := 0
+	switch totalPolicy {
+	case totalPolicyWarn:
+		return ValidationError{}, true
+	case totalPolicyTolerance:
+		cents, percent, _ := parseTolerance(totalTolerance)
+		allowed = cents + int(float64(itemsCents)*percent/100)
+	}
+	if difference <= allowed {
+		return ValidationError{}, true
+	}
+
+	return ValidationError{
+		Path: "/total",
+		Code: "total_mismatch",
+		Message: fmt.Sprintf("total of %s differs from the items' sum of %s by %s, more than the %s allowed",
+			formatCents(r.cents), formatCents(itemsCents), formatCents(difference), formatCents(allowed)),
+	}, false
+
+}
+
+/*
+TotalDiscrepancy flags a receipt whose total doesn't match the sum of its item
+prices, and is included with its score and breakdown. Difference is the total
+minus the items' sum, so it's negative when the total is lower.
+*/
+type TotalDiscrepancy struct {
+	Total      string `json:"total"`
+	ItemsTotal string `json:"itemsTotal"`
+	Difference string `json:"difference"`
+}
+
+// Describes the difference between a receipt's total and its items' sum, or
+// returns nil if there is none
+func totalDiscrepancy(r receipt) *TotalDiscrepancy {
+
+	itemsCents := r.itemsCents()
+	if r.cents == itemsCents {
+		return nil
+	}
+
+	difference := formatCents(r.cents - itemsCents)
+	if r.cents < itemsCents {
+		difference = "-" + formatCents(itemsCents-r.cents)
+	}
+	return &TotalDiscrepancy{
+		Total:      formatCents(r.cents),
+		ItemsTotal: formatCents(itemsCents),
+		Difference: difference,
+	}
+
+}
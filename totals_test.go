@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sets the total policy for the duration of a test
+func useTotalPolicy(t *testing.T, policy string, tolerance string) {
+
+	oldPolicy, oldTolerance := totalPolicy, totalTolerance
+	t.Cleanup(func() { totalPolicy, totalTolerance = oldPolicy, oldTolerance })
+	totalPolicy, totalTolerance = policy, tolerance
+
+}
+
+// A receipt whose items add up to 10.00, with the given total
+func mismatchedPayload(total string) []byte {
+
+	return []byte(`{"retailer": "Target", "purchaseDate": "2022-01-02", "purchaseTime": "13:13", "total": "` + total + `",
+		"items": [{"shortDescription": "Pepsi", "price": "6.00"}, {"shortDescription": "Dasani", "price": "4.00"}]}`)
+
+}
+
+func TestTotalPolicyWarn(t *testing.T) {
+
+	useFreshStore(t)
+	useTotalPolicy(t, totalPolicyWarn, "0.00")
+
+	id := testPostHelper(t, mismatchedPayload("10.25"))
+	br := testGetBreakdownHelper(t, id)
+	expected := TotalDiscrepancy{Total: "10.25", ItemsTotal: "10.00", Difference: "0.25"}
+	if br.TotalDiscrepancy == nil || *br.TotalDiscrepancy != expected {
+		t.Errorf("Expected discrepancy %+v but got %+v", expected, br.TotalDiscrepancy)
+	}
+
+	// A matching receipt isn't flagged
+	id = testPostHelper(t, mismatchedPayload("10.00"))
+	if br := testGetBreakdownHelper(t, id); br.TotalDiscrepancy != nil {
+		t.Errorf("Expected no discrepancy but got %+v", br.TotalDiscrepancy)
+	}
+
+}
+
+func TestTotalPolicyStrict(t *testing.T) {
+
+	useFreshStore(t)
+	useTotalPolicy(t, totalPolicyStrict, "0.00")
+
+	testPostHelper(t, mismatchedPayload("10.00"))
+	problems := testBadPostHelper(t, mismatchedPayload("9.99"))
+	expectProblems(t, problems, ValidationError{Path: "/total", Code: "total_mismatch"})
+
+}
+
+func TestTotalPolicyTolerance(t *testing.T) {
+
+	useFreshStore(t)
+
+	useTotalPolicy(t, totalPolicyTolerance, "1.00")
+	testPostHelper(t, mismatchedPayload("11.00"))
+	testPostHelper(t, mismatchedPayload("9.00"))
+	expectProblems(t, testBadPostHelper(t, mismatchedPayload("11.01")),
+		ValidationError{Path: "/total", Code: "total_mismatch"})
+
+	// 15% of 10.00 is 1.50
+	useTotalPolicy(t, totalPolicyTolerance, "15%")
+	testPostHelper(t, mismatchedPayload("11.50"))
+	expectProblems(t, testBadPostHelper(t, mismatchedPayload("11.51")),
+		ValidationError{Path: "/total", Code: "total_mismatch"})
+
+}
+
+func TestScoreReportsDiscrepancy(t *testing.T) {
+
+	useTotalPolicy(t, totalPolicyWarn, "0.00")
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/score", strings.NewReader(string(mismatchedPayload("9.50"))))
+	w := httptest.NewRecorder()
+	scoreReceipt(w, req)
+
+	var sr ScoreResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sr); err != nil {
+		t.Fatalf("Invalid JSON on score: %s", err)
+	}
+	if sr.TotalDiscrepancy == nil || sr.TotalDiscrepancy.Difference != "-0.50" {
+		t.Errorf("Expected a difference of -0.50 but got %+v", sr.TotalDiscrepancy)
+	}
+
+}
+
+func TestInvalidTotalPolicy(t *testing.T) {
+
+	cases := []struct{ policy, tolerance string }{
+		{"lenient", "0.00"},
+		{totalPolicyTolerance, "2"},
+		{totalPolicyTolerance, "-5%"},
+		{totalPolicyTolerance, "lots%"},
+	}
+	for _, c := range cases {
+		if err := validateTotalPolicy(c.policy, c.tolerance); err == nil {
+			t.Errorf("Expected policy %q with tolerance %q to be rejected", c.policy, c.tolerance)
+		}
+	}
+	if err := validateTotalPolicy(totalPolicyTolerance, "12.5%"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+}
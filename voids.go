@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+A receipt found to be fraudulent, or whose purchase was returned, is voided
+rather than deleted. It stays in the store, so that its history can still be
+looked up, but it earns nothing: voiding it posts a reversal of its points to
+its account's ledger, and from then on its points are answered with a 410.
+
+ReceiptVoid is the audit record kept with a voided receipt: why it was
+voided, by whom, when, and the address the request to void it came from.
+VoidedBy is whatever the client said; RemoteAddr is what the server saw.
+*/
+type ReceiptVoid struct {
+	Reason     string    `json:"reason"`
+	VoidedBy   string    `json:"voidedBy"`
+	VoidedAt   time.Time `json:"voidedAt"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+}
+
+// The debit posted to an account's ledger when one of its receipts is voided.
+// Like an adjustment, it only takes away what is left of the receipt's points.
+const entryReversal = "reversal"
+
+// Returned when voiding or saving a receipt that has already been voided
+var errReceiptVoided = errors.New("receipt has been voided")
+
+// VoidRequest is the body expected for DELETE requests to /receipts/{id}
+type VoidRequest struct {
+	Reason   string `json:"reason"`
+	VoidedBy string `json:"voidedBy"`
+}
+
+/*
+VoidResponse is the body returned when a receipt is voided. Reversal is the
+entry posted to the account's ledger, and is only present if the receipt was
+submitted for an account.
+*/
+type VoidResponse struct {
+	Id       string       `json:"id"`
+	Void     ReceiptVoid  `json:"void"`
+	Reversal *LedgerEntry `json:"reversal,omitempty"`
+}
+
+/*
+Handler for DELETE requests to /receipts/{id}, which voids the receipt. The
+body must give the reason and who is voiding it, both of which are kept with
+the receipt. Voiding a receipt twice gets a 409.
+
+Nothing checks who is voiding the receipt: voidedBy is self-reported, and
+anyone who can reach the server can void any receipt under any name. The
+request's remote address is kept as well, as the one part of the record the
+client doesn't choose, though behind a proxy it is the proxy's address.
+*/
+func deleteReceipt(w http.ResponseWriter, req *http.Request) {
+
+	id := strings.Split(req.URL.Path, "/")[2]
+
+	var request VoidRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+	var tooLarge *http.MaxBytesError
+	if err := decoder.Decode(&request); errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "The request body is larger than the limit of %d bytes.", tooLarge.Limit)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "The request to void the receipt is not valid JSON: %s", err)
+		return
+	}
+	if strings.TrimSpace(request.Reason) == "" || strings.TrimSpace(request.VoidedBy) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Voiding a receipt needs a reason and the name of whoever is voiding it.")
+		return
+	}
+
+	void := ReceiptVoid{
+		Reason:     request.Reason,
+		VoidedBy:   request.VoidedBy,
+		VoidedAt:   time.Now(),
+		RemoteAddr: req.RemoteAddr,
+	}
+	reversal, err := store.Void(id, void)
+	if errors.Is(err, errReceiptNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No receipt found for that ID.")
+		return
+	} else if errors.Is(err, errReceiptVoided) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "That receipt has already been voided.")
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "The receipt could not be voided.")
+		return
+	}
+
+	resp := VoidResponse{Id: id, Void: void}
+	if reversal.Sequence > 0 {
+		resp.Reversal = &reversal
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Sends a request to void the receipt and returns the recorded response
+func testVoidHelper(t *testing.T, id string, body string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodDelete, "/receipts/"+id, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	deleteReceipt(w, req)
+	return w
+
+}
+
+func TestVoidReceipt(t *testing.T) {
+
+	useFreshStore(t)
+	id := testPostForAccountHelper(t, accountPayload("02"), "card-1")
+	testPostForAccountHelper(t, accountPayload("03"), "card-1")
+
+	w := testVoidHelper(t, id, `{"reason": "Returned to the store", "voidedBy": "support-7"}`)
+	var resp VoidResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected OK but got %v: %s", w.Code, w.Body)
+	}
+	if resp.Id != id || resp.Void.Reason != "Returned to the store" || resp.Void.VoidedBy != "support-7" ||
+		resp.Void.VoidedAt.IsZero() || resp.Void.RemoteAddr != "192.0.2.1:1234" ||
+		resp.Reversal == nil || resp.Reversal.Points != -31 {
+		t.Errorf("Unexpected void response %+v", resp)
+	}
+	if balance, _, _ := store.GetBalance("card-1"); balance != 37 {
+		t.Errorf("Expected the points to be taken back, leaving 37, but got %v", balance)
+	}
+
+	// The points are gone, but the receipt and its breakdown are kept
+	w = testGetAccountHelper(t, getPoints, "/receipts/"+id+"/points")
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected Gone for the points of a voided receipt but got %v", w.Code)
+	}
+	w = testGetAccountHelper(t, getBreakdown, "/receipts/"+id+"/breakdown")
+	var br BreakdownResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &br); err != nil || br.Void == nil || br.Void.VoidedBy != "support-7" ||
+		br.Void.RemoteAddr != "192.0.2.1:1234" {
+		t.Errorf("Expected the breakdown to show the void but got %s", w.Body)
+	}
+
+	if w := testVoidHelper(t, id, `{"reason": "again", "voidedBy": "support-7"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected Conflict voiding twice but got %v", w.Code)
+	}
+
+	// Rescoring leaves the voided receipt alone
+	rescored, err := rescoreReceipts(activeRules.Load(), true)
+	if err != nil || len(rescored.Receipts) != 1 {
+		t.Errorf("Expected only the other receipt to be rescored but got %+v (error %v)", rescored, err)
+	}
+
+}
+
+func TestVoidReceiptErrors(t *testing.T) {
+
+	useFreshStore(t)
+	id := testPostHelper(t, []byte(batchReceiptA))
+
+	cases := []struct {
+		id     string
+		body   string
+		status int
+	}{
+		{"missing", `{"reason": "fraud", "voidedBy": "support-7"}`, http.StatusNotFound},
+		{id, `{"voidedBy": "support-7"}`, http.StatusBadRequest},
+		{id, `{"reason": "fraud", "voidedBy": " "}`, http.StatusBadRequest},
+		{id, `{"reason": "fraud", "voidedBy": "support-7", "extra": true}`, http.StatusBadRequest},
+		{id, ``, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := testVoidHelper(t, c.id, c.body); w.Code != c.status {
+			t.Errorf("Expected %v for %s but got %v: %s", c.status, c.body, w.Code, w.Body)
+		}
+	}
+
+	// A receipt without an account has nothing to reverse
+	w := testVoidHelper(t, id, `{"reason": "fraud", "voidedBy": "support-7"}`)
+	var resp VoidResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || resp.Reversal != nil {
+		t.Errorf("Expected OK without a reversal but got %v: %s", w.Code, w.Body)
+	}
+
+}
+
+func TestVoidSpentReceipt(t *testing.T) {
+
+	useFreshStore(t)
+	useExpiry(t, expiryPolicy{age: period{months: 12}})
+
+	// 31 points purchased on 2022-01-02, which expire first, and 37 on
+	// 2022-01-03
+	expired := testPostForAccountHelper(t, accountPayload("02"), "card-1")
+	redeemed := testPostForAccountHelper(t, accountPayload("03"), "card-1")
+	testPostForAccountHelper(t, accountPayload("05"), "card-1")
+	if n, err := sweepExpiredPoints(date("2023-01-02 20:00")); err != nil || n != 31 {
+		t.Fatalf("Expected 31 points to expire but got %v (error %v)", n, err)
+	}
+	if w := testRedeemHelper(t, "card-1", `"4"`, `{"points": 37}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected OK redeeming but got %v: %s", w.Code, w.Body)
+	}
+
+	// Neither receipt has points left to reverse, so the other receipt's
+	// points are untouched
+	for _, id := range []string{expired, redeemed} {
+		var resp VoidResponse
+		w := testVoidHelper(t, id, `{"reason": "fraud", "voidedBy": "support-7"}`)
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Reversal == nil || resp.Reversal.Points != 0 {
+			t.Errorf("Expected a reversal of nothing but got %v: %s", w.Code, w.Body)
+		}
+	}
+	if balance, _, _ := store.GetBalance("card-1"); balance != 37 {
+		t.Errorf("Expected the balance to stay at 37 but got %v", balance)
+	}
+
+}